@@ -31,7 +31,7 @@ func SetupTunnel() ipstack.MultiStream {
 	stream := tunnet.TunnelStream(tun, BufferSize, BufferSize)
 	stream = ipstack.FilterIPv4Valid(stream)
 	stream = ipstack.FilterIPv4Checksums(stream)
-	stream = ipstack.DefragmentIncomingIPv4(stream, 0)
+	stream = ipstack.DefragmentIncomingIPv4(stream, 0, nil)
 	stream = ipstack.FragmentOutgoingIPv4(stream, mtu)
 	stream = ipstack.AddIPv4Identifiers(stream)
 
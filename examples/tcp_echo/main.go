@@ -22,7 +22,7 @@ func main() {
 
 	tcpStream, err := multi.Fork(BufferSize)
 	essentials.Must(err)
-	tcpNet := ipstack.NewTCP4Net(tcpStream, examples.Gateway, nil, 0)
+	tcpNet := ipstack.NewTCP4NetConfig(tcpStream, examples.Gateway, nil, nil)
 
 	listener, err := tcpNet.ListenTCP(&net.TCPAddr{IP: examples.Gateway, Port: 1337})
 	essentials.Must(err)
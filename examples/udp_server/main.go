@@ -21,7 +21,7 @@ func main() {
 
 	udpStream, err := multi.Fork(BufferSize)
 	essentials.Must(err)
-	udpNet := ipstack.NewUDP4Net(udpStream, examples.Gateway, nil, 0, 0)
+	udpNet := ipstack.NewUDP4Net(udpStream, examples.Gateway, nil, 0, 0, nil)
 
 	listener, err := udpNet.ListenUDP(&net.UDPAddr{Port: 1337})
 	essentials.Must(err)
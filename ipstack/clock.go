@@ -0,0 +1,215 @@
+package ipstack
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock is a source of time and timers.
+//
+// Replacing the system clock with a ManualClock makes it
+// possible to test timeouts quickly and reproducibly.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer creates a Timer which sends the current
+	// time on its channel after d.
+	NewTimer(d time.Duration) Timer
+
+	// AfterFunc creates a Timer which calls f after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a single event from a Clock.
+// It behaves like a *time.Timer.
+type Timer interface {
+	// Chan gets the channel on which the time is sent.
+	// It is nil for timers created by AfterFunc.
+	Chan() <-chan time.Time
+
+	// Stop prevents the timer from firing.
+	// It returns false if the timer had already fired or
+	// been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after d.
+	// It returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// SystemClock creates a Clock which uses the time
+// package.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (s systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (s systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (s systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (s systemTimer) Chan() <-chan time.Time {
+	return s.C
+}
+
+// A ManualClock is a Clock which only moves when it is
+// advanced explicitly.
+//
+// Timers fire during calls to Advance, in order of their
+// deadlines. Functions passed to AfterFunc are called
+// synchronously, so their effects are visible once
+// Advance returns.
+type ManualClock struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock creates a ManualClock which starts at
+// the given time.
+func NewManualClock(start time.Time) *ManualClock {
+	res := &ManualClock{now: start}
+	res.cond = sync.NewCond(&res.lock)
+	return res
+}
+
+func (m *ManualClock) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.now
+}
+
+func (m *ManualClock) NewTimer(d time.Duration) Timer {
+	return m.addTimer(d, make(chan time.Time, 1), nil)
+}
+
+func (m *ManualClock) AfterFunc(d time.Duration, f func()) Timer {
+	return m.addTimer(d, nil, f)
+}
+
+// Advance moves the clock forward, firing every timer
+// whose deadline is reached.
+func (m *ManualClock) Advance(d time.Duration) {
+	m.lock.Lock()
+	end := m.now.Add(d)
+	for {
+		timer := m.nextTimer(end)
+		if timer == nil {
+			break
+		}
+		m.now = timer.deadline
+		m.removeTimer(timer)
+		now := m.now
+		m.lock.Unlock()
+		timer.fire(now)
+		m.lock.Lock()
+	}
+	m.now = end
+	m.lock.Unlock()
+}
+
+// WaitTimers blocks until at least n timers are pending.
+//
+// This can be used to wait for another Goroutine to
+// schedule a timeout before advancing the clock.
+func (m *ManualClock) WaitTimers(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for len(m.timers) < n {
+		m.cond.Wait()
+	}
+}
+
+func (m *ManualClock) addTimer(d time.Duration, ch chan time.Time, f func()) *manualTimer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := &manualTimer{clock: m, deadline: m.now.Add(d), ch: ch, f: f}
+	m.timers = append(m.timers, res)
+	m.cond.Broadcast()
+	return res
+}
+
+// nextTimer finds the pending timer with the earliest
+// deadline, if it is no later than end.
+// The caller must hold the lock.
+func (m *ManualClock) nextTimer(end time.Time) *manualTimer {
+	var res *manualTimer
+	for _, timer := range m.timers {
+		if timer.deadline.After(end) {
+			continue
+		}
+		if res == nil || timer.deadline.Before(res.deadline) {
+			res = timer
+		}
+	}
+	return res
+}
+
+// removeTimer removes a pending timer, returning false if
+// it was not pending.
+// The caller must hold the lock.
+func (m *ManualClock) removeTimer(timer *manualTimer) bool {
+	for i, t := range m.timers {
+		if t == timer {
+			// Keep the order so that timers with equal
+			// deadlines fire in the order they were set.
+			copy(m.timers[i:], m.timers[i+1:])
+			m.timers[len(m.timers)-1] = nil
+			m.timers = m.timers[:len(m.timers)-1]
+			return true
+		}
+	}
+	return false
+}
+
+type manualTimer struct {
+	clock    *ManualClock
+	deadline time.Time
+	ch       chan time.Time
+	f        func()
+}
+
+func (m *manualTimer) Chan() <-chan time.Time {
+	return m.ch
+}
+
+func (m *manualTimer) Stop() bool {
+	m.clock.lock.Lock()
+	defer m.clock.lock.Unlock()
+	return m.clock.removeTimer(m)
+}
+
+func (m *manualTimer) Reset(d time.Duration) bool {
+	m.clock.lock.Lock()
+	defer m.clock.lock.Unlock()
+	active := m.clock.removeTimer(m)
+	m.deadline = m.clock.now.Add(d)
+	m.clock.timers = append(m.clock.timers, m)
+	m.clock.cond.Broadcast()
+	return active
+}
+
+func (m *manualTimer) fire(now time.Time) {
+	if m.f != nil {
+		m.f()
+		return
+	}
+	select {
+	case m.ch <- now:
+	default:
+	}
+}
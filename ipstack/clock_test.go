@@ -0,0 +1,70 @@
+package ipstack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+
+	var fired []int
+	clock.AfterFunc(time.Second*2, func() {
+		fired = append(fired, 2)
+	})
+	clock.AfterFunc(time.Second, func() {
+		if now := clock.Now(); !now.Equal(start.Add(time.Second)) {
+			t.Error("unexpected time in callback:", now)
+		}
+		fired = append(fired, 1)
+	})
+	stopped := clock.AfterFunc(time.Second, func() {
+		fired = append(fired, 0)
+	})
+	timer := clock.NewTimer(time.Second * 3)
+
+	if !stopped.Stop() {
+		t.Error("timer should have been active")
+	}
+	if stopped.Stop() {
+		t.Error("timer should have been stopped")
+	}
+
+	clock.Advance(time.Second * 2)
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 2 {
+		t.Fatal("unexpected callbacks:", fired)
+	}
+	if now := clock.Now(); !now.Equal(start.Add(time.Second * 2)) {
+		t.Fatal("unexpected time:", now)
+	}
+
+	timer.Reset(time.Second)
+	clock.Advance(time.Second - 1)
+	select {
+	case <-timer.Chan():
+		t.Fatal("timer fired early")
+	default:
+	}
+	clock.Advance(1)
+	select {
+	case now := <-timer.Chan():
+		if !now.Equal(start.Add(time.Second * 3)) {
+			t.Error("unexpected time:", now)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	if timer.Stop() {
+		t.Error("timer should have fired")
+	}
+}
+
+func TestManualClockWaitTimers(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		clock.NewTimer(time.Second)
+	}()
+	clock.WaitTimers(1)
+}
@@ -0,0 +1,226 @@
+package ipstack
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	demuxClosedErr   = errors.New("demux: stream closed")
+	demuxKeyInUseErr = errors.New("demux: address in use")
+)
+
+// A demuxKey identifies the endpoint which owns incoming
+// packets, relative to a local address.
+//
+// Listening endpoints leave the remote address zero, and
+// the zero key matches packets with no other owner.
+type demuxKey struct {
+	localPort  int
+	remoteIP   [4]byte
+	remotePort int
+}
+
+func newDemuxKey(localPort int, remoteIP net.IP, remotePort int) demuxKey {
+	key := demuxKey{localPort: localPort, remotePort: remotePort}
+	copy(key.remoteIP[:], remoteIP.To4())
+	return key
+}
+
+// A demuxFunc computes the key for an incoming packet.
+type demuxFunc func(packet []byte) demuxKey
+
+// A demuxTable routes each packet from a Stream to a
+// single child Stream, looked up by the packet's key.
+//
+// Unlike a MultiStream, packets are neither copied nor
+// filtered by every child, so the cost of routing does
+// not grow with the number of children.
+//
+// A packet is routed to the child with its exact key if
+// there is one, then to the listening child for its
+// local port, then to the child with the zero key.
+// Packets with no matching child are dropped.
+type demuxTable struct {
+	stream    Stream
+	keyFunc   demuxFunc
+	lock      sync.Mutex
+	children  map[demuxKey]*demuxStream
+	closeChan chan struct{}
+}
+
+func newDemuxTable(stream Stream, keyFunc demuxFunc) *demuxTable {
+	res := &demuxTable{
+		stream:    stream,
+		keyFunc:   keyFunc,
+		children:  map[demuxKey]*demuxStream{},
+		closeChan: make(chan struct{}),
+	}
+	go res.readLoop()
+	return res
+}
+
+// Add creates a Stream which receives the packets routed
+// to a key, and writes to the underlying Stream.
+//
+// The child Stream will buffer up to readBuffer packets,
+// after which point packets will be dropped.
+//
+// The key is released when the child is closed.
+func (d *demuxTable) Add(key demuxKey, readBuffer int) (Stream, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed() {
+		return nil, demuxClosedErr
+	} else if _, ok := d.children[key]; ok {
+		return nil, demuxKeyInUseErr
+	}
+	child := &demuxStream{
+		parent:   d,
+		key:      key,
+		incoming: make(chan []byte, readBuffer),
+		outgoing: make(chan []byte),
+		done:     make(chan struct{}),
+	}
+	go d.forwardOutgoing(child)
+	d.children[key] = child
+	return child, nil
+}
+
+// Close closes the underlying Stream and all the child
+// streams.
+func (d *demuxTable) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed() {
+		return AlreadyClosedErr
+	}
+
+	close(d.closeChan)
+	d.stream.Close()
+
+	for _, child := range d.children {
+		close(child.done)
+		close(child.incoming)
+	}
+	d.children = nil
+
+	return nil
+}
+
+// forwardOutgoing writes a child's packets to the
+// underlying Stream until the child is closed.
+//
+// A packet which the child wrote before it was closed is
+// still delivered, so that a connection's final segment,
+// such as a RST, is not lost.
+func (d *demuxTable) forwardOutgoing(child *demuxStream) {
+	for {
+		select {
+		case packet := <-child.outgoing:
+			select {
+			case d.stream.Outgoing() <- packet:
+			case <-d.closeChan:
+				return
+			}
+		case <-child.done:
+			return
+		case <-d.closeChan:
+			return
+		}
+	}
+}
+
+func (d *demuxTable) readLoop() {
+	defer d.Close()
+	for {
+		select {
+		case packet := <-d.stream.Incoming():
+			if !d.handleIncoming(packet) {
+				return
+			}
+		case <-d.stream.Done():
+			return
+		case <-d.closeChan:
+			return
+		}
+	}
+}
+
+func (d *demuxTable) handleIncoming(packet []byte) bool {
+	if packet == nil {
+		return false
+	}
+	key := d.keyFunc(packet)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed() {
+		return false
+	}
+
+	child, ok := d.children[key]
+	if !ok {
+		child, ok = d.children[demuxKey{localPort: key.localPort}]
+	}
+	if !ok {
+		child, ok = d.children[demuxKey{}]
+	}
+	if ok {
+		select {
+		case child.incoming <- packet:
+		default:
+		}
+	}
+
+	return true
+}
+
+func (d *demuxTable) closed() bool {
+	select {
+	case <-d.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *demuxTable) childClose(child *demuxStream) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.children[child.key] != child {
+		return AlreadyClosedErr
+	}
+	delete(d.children, child.key)
+	close(child.done)
+	close(child.incoming)
+	return nil
+}
+
+type demuxStream struct {
+	parent   *demuxTable
+	key      demuxKey
+	incoming chan []byte
+	outgoing chan []byte
+	done     chan struct{}
+}
+
+func (d *demuxStream) Incoming() <-chan []byte {
+	return d.incoming
+}
+
+func (d *demuxStream) Outgoing() chan<- []byte {
+	return d.outgoing
+}
+
+func (d *demuxStream) Close() error {
+	return d.parent.childClose(d)
+}
+
+func (d *demuxStream) Done() <-chan struct{} {
+	return d.done
+}
@@ -0,0 +1,110 @@
+package ipstack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDemuxTableRouting(t *testing.T) {
+	parent, pipe := Pipe(10)
+	demux := newDemuxTable(parent, udp4DemuxKey)
+	defer demux.Close()
+
+	local := net.IP{10, 0, 0, 1}
+	remote1 := &net.UDPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	remote2 := &net.UDPAddr{IP: net.IP{10, 0, 0, 3}, Port: 1337}
+
+	conn, err := demux.Add(newDemuxKey(80, remote1.IP, remote1.Port), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := demux.Add(demuxKey{localPort: 80}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := demux.Add(demuxKey{}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := demux.Add(demuxKey{localPort: 80}, 10); err != demuxKeyInUseErr {
+		t.Fatal("expected key in use but got", err)
+	}
+
+	send := func(remote *net.UDPAddr, port int, data string) {
+		packet := NewUDP4Packet(DefaultTTL, remote, &net.UDPAddr{IP: local, Port: port},
+			[]byte(data))
+		Send(pipe, packet)
+	}
+	expect := func(stream Stream, data string) {
+		select {
+		case packet := <-stream.Incoming():
+			if !bytes.Equal(UDP4Packet(packet).Payload(), []byte(data)) {
+				t.Errorf("expected %q but got %q", data, UDP4Packet(packet).Payload())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q but got nothing", data)
+		}
+	}
+
+	send(remote1, 80, "conn")
+	expect(conn, "conn")
+	send(remote2, 80, "listener")
+	expect(listener, "listener")
+	send(remote1, 81, "fallback")
+	expect(fallback, "fallback")
+
+	// Closing a child releases its key.
+	conn.Close()
+	send(remote1, 80, "listener again")
+	expect(listener, "listener again")
+	if _, err := demux.Add(newDemuxKey(80, remote1.IP, remote1.Port), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	Send(listener, []byte("test"))
+	if !bytes.Equal(<-pipe.Incoming(), []byte("test")) {
+		t.Error("unexpected packet")
+	}
+
+	// A packet written right before a close is not lost.
+	Send(fallback, []byte("last"))
+	fallback.Close()
+	select {
+	case packet := <-pipe.Incoming():
+		if !bytes.Equal(packet, []byte("last")) {
+			t.Error("unexpected packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet was dropped")
+	}
+}
+
+func TestDemuxTableClose(t *testing.T) {
+	parent, _ := Pipe(10)
+	demux := newDemuxTable(parent, udp4DemuxKey)
+
+	stream1, err := demux.Add(demuxKey{localPort: 1}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream2, err := demux.Add(demuxKey{localPort: 2}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	demux.Close()
+
+	<-stream1.Incoming()
+	<-stream1.Done()
+	<-stream2.Done()
+	<-stream2.Incoming()
+
+	if _, err := demux.Add(demuxKey{localPort: 3}, 10); err != demuxClosedErr {
+		t.Fatal("expected closed error but got", err)
+	}
+	if err := stream1.Close(); err != AlreadyClosedErr {
+		t.Fatal("expected already closed but got", err)
+	}
+}
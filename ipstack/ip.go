@@ -8,6 +8,21 @@ import (
 
 const DefaultTTL = 64
 
+// DefaultMTU is the default maximum size of a packet,
+// including the IP header.
+const DefaultMTU = 1500
+
+// An ECN is an Explicit Congestion Notification
+// codepoint, as described in RFC 3168.
+type ECN uint8
+
+const (
+	ECNNotECT ECN = iota
+	ECNECT1
+	ECNECT0
+	ECNCE
+)
+
 // An IPv4Packet is a single packet intended to be sent or
 // received on an IPv4 connection.
 type IPv4Packet []byte
@@ -110,6 +125,20 @@ func (i IPv4Packet) SetTTL(ttl int) {
 	i[8] = byte(ttl)
 }
 
+// ECN extracts the ECN codepoint from the packet's
+// type of service field.
+func (i IPv4Packet) ECN() ECN {
+	return ECN(i[1] & 3)
+}
+
+// SetECN sets the ECN codepoint in the packet's type of
+// service field.
+//
+// The checksum must be updated afterwards.
+func (i IPv4Packet) SetECN(ecn ECN) {
+	i[1] = (i[1] &^ 3) | byte(ecn&3)
+}
+
 // Proto extracts the protocol ID from the packet.
 func (i IPv4Packet) Proto() int {
 	return int(i[9])
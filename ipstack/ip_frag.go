@@ -21,12 +21,18 @@ const DefaultDefragmentTimeout = time.Second
 // packets around before giving up on them.
 // If 0 is passed, DefaultDefragmentTimeout is used.
 //
+// The clock is used to measure the timeout.
+// If nil, SystemClock() is used.
+//
 // All incoming packets are assumed to be valid.
-func DefragmentIncomingIPv4(stream Stream, timeout time.Duration) Stream {
+func DefragmentIncomingIPv4(stream Stream, timeout time.Duration, clock Clock) Stream {
 	if timeout == 0 {
 		timeout = DefaultDefragmentTimeout
 	}
-	defrag := &ipv4Defragmenter{timeout: int64(timeout / time.Nanosecond)}
+	if clock == nil {
+		clock = SystemClock()
+	}
+	defrag := &ipv4Defragmenter{timeout: int64(timeout / time.Nanosecond), clock: clock}
 	return Filter(stream, func(packet []byte) []byte {
 		ipPacket := IPv4Packet(packet)
 		_, more, offset := ipPacket.FragmentInfo()
@@ -78,7 +84,7 @@ func (i *ipv4Fragmenter) forwardLoop() {
 }
 
 func (i *ipv4Fragmenter) fragments(packet IPv4Packet) []IPv4Packet {
-	if len(packet) < i.mtu {
+	if len(packet) <= i.mtu {
 		return []IPv4Packet{packet}
 	}
 	ipPacket := IPv4Packet(packet)
@@ -117,6 +123,7 @@ func (i *ipv4Fragmenter) fragments(packet IPv4Packet) []IPv4Packet {
 // reconstructions.
 type ipv4Defragmenter struct {
 	timeout         int64
+	clock           Clock
 	reconstructions []*ipv4Reconstruction
 }
 
@@ -138,7 +145,7 @@ func (i *ipv4Defragmenter) AddPacket(p IPv4Packet) IPv4Packet {
 		}
 	}
 	i.reconstructions = append(i.reconstructions, &ipv4Reconstruction{
-		DropTime:       time.Now().UnixNano() + i.timeout,
+		DropTime:       i.clock.Now().UnixNano() + i.timeout,
 		Identification: p.Identification(),
 		Source:         p.SourceAddr(),
 		Fragments:      []IPv4Packet{p},
@@ -147,7 +154,7 @@ func (i *ipv4Defragmenter) AddPacket(p IPv4Packet) IPv4Packet {
 }
 
 func (i *ipv4Defragmenter) dropOld() {
-	curTime := time.Now().UnixNano()
+	curTime := i.clock.Now().UnixNano()
 	for j := 0; j < len(i.reconstructions); j++ {
 		recon := i.reconstructions[j]
 		if curTime >= recon.DropTime {
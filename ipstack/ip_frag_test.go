@@ -16,7 +16,7 @@ func TestFragmentation(t *testing.T) {
 	sender = AddIPv4Identifiers(FragmentOutgoingIPv4(sender, 133))
 	receiver = FilterIPv4Valid(receiver)
 	receiver = FilterIPv4Checksums(receiver)
-	receiver = DefragmentIncomingIPv4(receiver, time.Second*3)
+	receiver = DefragmentIncomingIPv4(receiver, time.Second*3, nil)
 
 	packets := make([][]byte, 30)
 	for i := range packets {
@@ -50,6 +50,45 @@ IncomingLoop:
 	}
 }
 
+func TestDefragmentTimeout(t *testing.T) {
+	sender, receiver := Pipe(10)
+	clock := NewManualClock(time.Unix(0, 0))
+	receiver = DefragmentIncomingIPv4(receiver, time.Second, clock)
+
+	payload := make([]byte, 100)
+	rand.Read(payload)
+	packet := NewIPv4Packet(DefaultTTL, ProtocolNumberICMP, net.IP{10, 0, 0, 1},
+		net.IP{10, 0, 0, 2}, payload)
+	fragments := (&ipv4Fragmenter{mtu: 60}).fragments(packet)
+	marker := NewIPv4Packet(DefaultTTL, ProtocolNumberICMP, net.IP{10, 0, 0, 1},
+		net.IP{10, 0, 0, 2}, []byte("marker"))
+
+	// The first fragment is dropped before the others
+	// arrive, so the packet cannot be reassembled until
+	// it is sent again.
+	// Packets are processed in order, so the marker shows
+	// that the fragments before it were handled.
+	expectMarker := func() {
+		Send(sender, marker)
+		if !bytes.Equal(<-receiver.Incoming(), marker) {
+			t.Fatal("expected marker packet")
+		}
+	}
+
+	Send(sender, fragments[0])
+	expectMarker()
+	clock.Advance(time.Second)
+	for _, fragment := range fragments[1:] {
+		Send(sender, fragment)
+	}
+	expectMarker()
+
+	Send(sender, fragments[0])
+	if !bytes.Equal(<-receiver.Incoming(), packet) {
+		t.Fatal("expected reassembled packet")
+	}
+}
+
 type randomLatencyStream struct {
 	Stream
 	outgoing chan []byte
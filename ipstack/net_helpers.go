@@ -19,11 +19,11 @@ type streamConn struct {
 	writeDeadline *deadlineManager
 }
 
-func newStreamConn(stream Stream) *streamConn {
+func newStreamConn(stream Stream, clock Clock) *streamConn {
 	return &streamConn{
 		stream:        stream,
-		readDeadline:  newDeadlineManager(),
-		writeDeadline: newDeadlineManager(),
+		readDeadline:  newDeadlineManager(clock),
+		writeDeadline: newDeadlineManager(clock),
 	}
 }
 
@@ -83,13 +83,14 @@ func (s *streamConn) SetWriteDeadline(t time.Time) error {
 }
 
 type deadlineManager struct {
+	clock    Clock
 	lock     sync.Mutex
-	curTimer *time.Timer
+	curTimer Timer
 	curChan  chan struct{}
 }
 
-func newDeadlineManager() *deadlineManager {
-	return &deadlineManager{curChan: make(chan struct{})}
+func newDeadlineManager(clock Clock) *deadlineManager {
+	return &deadlineManager{clock: clock, curChan: make(chan struct{})}
 }
 
 func (d *deadlineManager) Chan() <-chan struct{} {
@@ -111,7 +112,7 @@ func (d *deadlineManager) SetDeadline(deadline time.Time) {
 	default:
 	}
 	if !deadline.IsZero() {
-		d.curTimer = time.AfterFunc(deadline.Sub(time.Now()), func() {
+		d.curTimer = d.clock.AfterFunc(deadline.Sub(d.clock.Now()), func() {
 			d.lock.Lock()
 			defer d.lock.Unlock()
 			select {
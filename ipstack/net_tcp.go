@@ -4,27 +4,140 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// DefaultTCPRecvBuffer is the default number of bytes
+// buffered for each incoming TCP stream.
+const DefaultTCPRecvBuffer = 1 << 16
+
+// DefaultTCPSendBuffer is the default number of bytes
+// buffered for each outgoing TCP stream.
+const DefaultTCPSendBuffer = 1 << 16
+
+// DefaultTCPBacklog is the default maximum number of
+// connections which a listener keeps in the process of
+// being established or accepted.
+const DefaultTCPBacklog = 128
+
+// tcpMaxChallengeAckRate is the maximum number of
+// challenge ACKs that a connection sends per second, as
+// recommended by RFC 5961.
+const tcpMaxChallengeAckRate = 10
+
+var (
+	lingerTimeoutErr   = &timeoutError{Context: "linger"}
+	finWait2TimeoutErr = &timeoutError{Context: "FIN-WAIT-2"}
 )
 
+// A TCPConn is an abstract TCP connection.
+//
+// Connections returned by a TCPNet's listeners also
+// implement TCPConn.
+type TCPConn interface {
+	net.Conn
+
+	// CloseRead shuts down the reading side of the
+	// connection. Subsequent reads return io.EOF.
+	CloseRead() error
+
+	// CloseWrite shuts down the writing side of the
+	// connection. A FIN is sent once the buffered data has
+	// been sent, but CloseWrite does not wait for it.
+	CloseWrite() error
+
+	// WriteUrgent writes data which is marked as urgent,
+	// as described in RFC 6093. The remote end receives
+	// the data inline.
+	WriteUrgent(b []byte) (int, error)
+
+	// UrgentOffset checks if urgent data is pending in the
+	// incoming stream. If so, it returns the number of
+	// bytes which must be read to reach the end of the
+	// urgent data. Reads stop at the end of urgent data,
+	// so that it can be located in the stream.
+	UrgentOffset() (n int, ok bool)
+
+	// State gets the current state of the connection.
+	State() TCPState
+
+	// RTT gets the smoothed round-trip time of the
+	// connection, or 0 if it has not been measured.
+	RTT() time.Duration
+
+	// RecoveryStats gets counters describing how the
+	// connection has recovered from lost segments.
+	RecoveryStats() TCPRecoveryStats
+
+	// SetCongestionControl replaces the connection's
+	// congestion controller with a new one created by cc.
+	SetCongestionControl(cc CongestionControl)
+
+	// SetKeepAliveConfig configures keepalive probes.
+	SetKeepAliveConfig(config TCPKeepAlive)
+
+	// SetNoDelay controls whether small segments are
+	// delayed while data is unacknowledged (Nagle's
+	// algorithm).
+	// By default, noDelay is false.
+	SetNoDelay(noDelay bool) error
+
+	// SetLinger sets the behavior of Close.
+	//
+	// If sec is negative (the default), Close returns
+	// immediately, and any unsent data and the FIN are
+	// sent in the background.
+	// If sec is 0, Close discards unsent data and resets
+	// the connection immediately.
+	// If sec is positive, Close waits at most sec seconds
+	// for the FIN to be acknowledged before resetting the
+	// connection.
+	SetLinger(sec int) error
+}
+
 // A TCPNet performs functions for a TCP host.
-// In particular, it can create net.Conns for TCP
-// connections.
+// In particular, it can create TCPConns.
 type TCPNet interface {
-	DialTCP(addr *net.TCPAddr) (net.Conn, error)
+	DialTCP(addr *net.TCPAddr) (TCPConn, error)
 	ListenTCP(addr *net.TCPAddr) (net.Listener, error)
+
+	// DialTCPConfig and ListenTCPConfig are like DialTCP
+	// and ListenTCP, but override the network's
+	// configuration.
+	// Zero fields of config use the defaults, not the
+	// network's configuration.
+	DialTCPConfig(addr *net.TCPAddr, config *TCPConfig) (TCPConn, error)
+	ListenTCPConfig(addr *net.TCPAddr, config *TCPConfig) (net.Listener, error)
+
 	Close() error
 }
 
 type tcp4Net struct {
-	stream MultiStream
+	demux  *demuxTable
 	laddr  net.IP
 	ports  PortAllocator
-	ttl    int
+	config *TCPConfig
+	resets *tcpResetter
+	isns   *tcpISNGenerator
 }
 
 // NewTCP4Net creates a TCPNet on top of a Stream.
 //
+// It is like NewTCP4NetConfig, but uses the default
+// configuration, including DefaultTCPMSS.
+//
+// The ttl argument is used as the TTL field for all
+// outgoing packets.
+// If 0, DefaultTTL is used.
+func NewTCP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl int) TCPNet {
+	return NewTCP4NetConfig(stream, laddr, ports, &TCPConfig{TTL: ttl})
+}
+
+// NewTCP4NetConfig creates a TCPNet on top of a Stream.
+//
 // The stream is an IPv4 stream that should automatically
 // filter out invalid packets and perform fragmentation.
 //
@@ -35,16 +148,16 @@ type tcp4Net struct {
 // The ports argument is used to allocate ports.
 // If nil, BasicPortAllocator() is used.
 //
-// The ttl argument is used as the TTL field for all
-// outgoing packets.
-// If 0, DefaultTTL is used.
-func NewTCP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl int) TCPNet {
+// The config is the default configuration for listeners
+// and connections. If nil, defaults are used.
+//
+// Segments which match no listener or connection are
+// answered with a RST, at a limited rate.
+func NewTCP4NetConfig(stream Stream, laddr net.IP, ports PortAllocator,
+	config *TCPConfig) TCPNet {
 	if ports == nil {
 		ports = BasicPortAllocator()
 	}
-	if ttl == 0 {
-		ttl = DefaultTTL
-	}
 	stream = FilterIPv4Proto(stream, ProtocolNumberTCP)
 	stream = FilterIPv4Dest(stream, laddr)
 	stream = Filter(stream, func(packet []byte) []byte {
@@ -54,47 +167,134 @@ func NewTCP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl int) TCPNe
 		}
 		return nil
 	}, nil)
-	return &tcp4Net{
-		stream: Multiplex(stream),
+
+	config = newTCPConfig(config)
+	res := &tcp4Net{
+		demux:  newDemuxTable(stream, tcp4DemuxKey),
 		laddr:  laddr,
 		ports:  ports,
-		ttl:    ttl,
+		config: config,
+		resets: newTCPResetter(config.TTL, config.Clock),
+		isns:   newTCPISNGenerator(),
 	}
+
+	// Segments which match no connection or listener are
+	// routed to the zero key.
+	resetStream, _ := res.demux.Add(demuxKey{}, 16)
+	go res.resetLoop(resetStream)
+	return res
 }
 
-func (t *tcp4Net) DialTCP(addr *net.TCPAddr) (net.Conn, error) {
-	return nil, errors.New("not yet implemented")
+func (t *tcp4Net) DialTCP(addr *net.TCPAddr) (TCPConn, error) {
+	return t.dial(addr, t.config)
 }
 
-func (t *tcp4Net) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
-	stream, err := t.stream.Fork(16)
+func (t *tcp4Net) DialTCPConfig(addr *net.TCPAddr, config *TCPConfig) (TCPConn, error) {
+	return t.dial(addr, newTCPConfig(config))
+}
+
+func (t *tcp4Net) dial(addr *net.TCPAddr, config *TCPConfig) (conn TCPConn, err error) {
+	defer essentials.AddCtxTo("dial TCP", &err)
+
+	if addr.IP.To4() == nil {
+		return nil, errors.New("invalid destination address")
+	}
+
+	laddr := &net.TCPAddr{IP: t.laddr}
+	if laddr.Port, err = t.ports.AllocRemote(addr); err != nil {
+		return nil, err
+	}
+	stream, err := t.demux.Add(newDemuxKey(laddr.Port, addr.IP, addr.Port), 16)
 	if err != nil {
-		return nil, io.ErrClosedPipe
+		t.ports.FreeRemote(addr, laddr.Port)
+		return nil, err
 	}
+	go func() {
+		<-stream.Done()
+		t.ports.FreeRemote(addr, laddr.Port)
+	}()
+
+	isn := t.isns.ISN(laddr, addr, config.Clock.Now())
+	handshake, err := tcp4ClientHandshake(stream, laddr, addr, isn, config)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	res := newTCP4Conn(stream, laddr, addr, handshake, config)
+	go res.loop()
+	return res, nil
+}
+
+func (t *tcp4Net) ListenTCP(addr *net.TCPAddr) (net.Listener, error) {
+	return t.listen(addr, t.config)
+}
+
+func (t *tcp4Net) ListenTCPConfig(addr *net.TCPAddr,
+	config *TCPConfig) (net.Listener, error) {
+	return t.listen(addr, newTCPConfig(config))
+}
+
+func (t *tcp4Net) listen(addr *net.TCPAddr, config *TCPConfig) (net.Listener, error) {
 	if err := t.ports.Alloc(addr.Port); err != nil {
 		return nil, err
 	}
+	stream, err := t.demux.Add(demuxKey{localPort: addr.Port}, 16)
+	if err != nil {
+		t.ports.Free(addr.Port)
+		return nil, err
+	}
 	res := &tcp4Listener{
-		stream: Multiplex(stream),
+		stream: stream,
+		demux:  t.demux,
+		resets: t.resets,
+		isns:   t.isns,
 		addr:   addr,
-		conns:  make(chan *tcp4Conn, 1),
-		ttl:    t.ttl,
+		conns:  make(chan *tcp4Conn, config.Backlog),
 		ports:  t.ports,
+		config: config,
+		closed: make(chan struct{}),
+	}
+	if config.SYNCookies {
+		res.cookies = newTCPCookieJar(config.Clock)
 	}
 	go res.loop()
 	return res, nil
 }
 
 func (t *tcp4Net) Close() error {
-	return t.stream.Close()
+	return t.demux.Close()
+}
+
+// resetLoop answers segments for unknown connections
+// with RSTs.
+func (t *tcp4Net) resetLoop(stream Stream) {
+	for packet := range stream.Incoming() {
+		t.resets.Reject(stream, TCP4Packet(packet))
+	}
 }
 
 type tcp4Listener struct {
-	stream MultiStream
+	stream Stream
+	demux  *demuxTable
+	resets *tcpResetter
+	isns   *tcpISNGenerator
 	addr   *net.TCPAddr
 	conns  chan *tcp4Conn
-	ttl    int
 	ports  PortAllocator
+	config *TCPConfig
+
+	// closed is closed by Close, which also closes the
+	// listener's connections.
+	closed chan struct{}
+
+	// If non-nil, SYN cookies are used when the backlog
+	// is full.
+	cookies *tcpCookieJar
+
+	// The number of handshakes in progress.
+	pendingLock sync.Mutex
+	pending     int
+	handshakes  sync.WaitGroup
 }
 
 func (t *tcp4Listener) Accept() (net.Conn, error) {
@@ -109,6 +309,7 @@ func (t *tcp4Listener) Close() error {
 	if err := t.stream.Close(); err != nil {
 		return err
 	}
+	close(t.closed)
 	return t.ports.Free(t.addr.Port)
 }
 
@@ -118,38 +319,157 @@ func (t *tcp4Listener) Addr() net.Addr {
 
 func (t *tcp4Listener) loop() {
 	defer close(t.conns)
-	stream, err := t.stream.Fork(10)
+	defer t.handshakes.Wait()
+
+	// Segments for existing connections and handshakes are
+	// routed to them directly, so the listener only sees
+	// segments which match no connection.
+	for packet := range t.stream.Incoming() {
+		tp := TCP4Packet(packet)
+		header := tp.Header()
+		if tcpIsSyn(header) {
+			if t.startHandshake() {
+				t.handshake(tp)
+			} else if t.cookies != nil {
+				t.sendCookie(tp)
+			}
+		} else if t.cookies != nil && tcpIsCookieAck(header) {
+			t.handleCookieAck(tp)
+		} else {
+			t.resets.Reject(t.stream, tp)
+		}
+	}
+}
+
+// handshake starts a handshake in the background.
+func (t *tcp4Listener) handshake(syn TCP4Packet) {
+	stream, err := t.addConn(syn)
 	if err != nil {
+		// If the key is in use, the SYN was retransmitted
+		// before the first handshake began.
+		t.finishHandshake(nil)
 		return
 	}
-	stream = filterTCP4Dest(stream, t.addr)
-	stream = filterTCP4Syn(stream)
-	for packet := range stream.Incoming() {
-		tp := TCP4Packet(packet)
 
-		stream, err := t.stream.Fork(10)
+	go func() {
+		isn := t.isns.ISN(syn.DestAddr(), syn.SourceAddr(), t.config.Clock.Now())
+		handshake, err := tcp4ServerHandshake(stream, syn, isn, t.config)
 		if err != nil {
+			stream.Close()
+			t.finishHandshake(nil)
 			return
 		}
-		stream = filterTCP4Source(stream, tp.SourceAddr())
-		stream = filterTCP4Dest(stream, tp.DestAddr())
+		conn := newTCP4Conn(stream, syn.DestAddr(), syn.SourceAddr(), handshake, t.config)
+		go conn.loop()
+		t.finishHandshake(conn)
+	}()
+}
 
-		handshake, err := tcp4ServerHandshake(stream, tp, t.ttl)
-		if err != nil {
+// sendCookie replies to a SYN with a SYN cookie.
+//
+// The cookie encodes the peer's MSS, while the SYN/ACK
+// advertises our own as usual. SYNs with an MSS too small
+// to encode are dropped.
+func (t *tcp4Listener) sendCookie(syn TCP4Packet) {
+	cookie, ok := t.cookies.Cookie(syn, parseTCPSynOptions(syn.Header()).mss)
+	if !ok {
+		return
+	}
+	synAck := NewTCP4PacketOptions(t.config.TTL, syn.DestAddr(), syn.SourceAddr(), cookie,
+		syn.Header().SeqNum()+1, tcpSynWindow(t.config.RecvBuffer),
+		[]*TCPOption{NewTCPOptionMSS(uint16(t.config.MSS))}, nil, SYN, ACK)
+	Send(t.stream, synAck)
+}
+
+// handleCookieAck creates a connection from an ACK which
+// completes a SYN cookie handshake.
+func (t *tcp4Listener) handleCookieAck(ack TCP4Packet) {
+	mss, ok := t.cookies.Check(ack)
+	if !ok {
+		t.resets.Reject(t.stream, ack)
+		return
+	}
+	t.pendingLock.Lock()
+	defer t.pendingLock.Unlock()
+	if len(t.conns) == cap(t.conns) {
+		// The peer will retransmit any data it sent, giving
+		// us another chance later.
+		return
+	}
+
+	stream, err := t.addConn(ack)
+	if err != nil {
+		return
+	}
+	handshake := &tcpHandshake{
+		localSeq:      ack.Header().AckNum(),
+		remoteSeq:     ack.Header().SeqNum(),
+		localWinSize:  tcpSynWindow(t.config.RecvBuffer),
+		remoteWinSize: uint32(ack.Header().WindowSize()),
+		mss:           tcpMinMSS(uint16(t.config.MSS), mss),
+	}
+	conn := newTCP4Conn(stream, ack.DestAddr(), ack.SourceAddr(), handshake, t.config)
+	if len(ack.Payload()) > 0 || ack.Header().Flag(FIN) {
+		// The ACK may carry data, which the peer would
+		// otherwise have to retransmit. The loop has not
+		// started, so it is safe to handle it here.
+		conn.handlePacket(ack)
+		conn.advance()
+	}
+	go conn.loop()
+	t.conns <- conn
+}
+
+// addConn registers a stream for the connection which
+// an incoming segment belongs to.
+// The stream is closed if the listener is closed first.
+func (t *tcp4Listener) addConn(packet TCP4Packet) (Stream, error) {
+	stream, err := t.demux.Add(tcp4DemuxKey(packet), 10)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-t.closed:
 			stream.Close()
-			continue
+		case <-stream.Done():
 		}
-		conn := &tcp4Conn{
-			stream: stream,
-			laddr:  tp.DestAddr(),
-			raddr:  tp.SourceAddr(),
-			recv:   newSimpleTcpRecv(handshake.remoteSeq, 4096),
-			send:   newSimpleTcpSend(handshake.localSeq, handshake.remoteWinSize, handshake.mss),
-			ttl:    t.ttl,
+	}()
+	return stream, nil
+}
+
+// startHandshake reserves room in the backlog for a new
+// connection.
+// It returns false if the backlog is full.
+func (t *tcp4Listener) startHandshake() bool {
+	t.pendingLock.Lock()
+	defer t.pendingLock.Unlock()
+	if t.pending >= t.config.Backlog || len(t.conns) == cap(t.conns) {
+		return false
+	}
+	t.pending++
+	t.handshakes.Add(1)
+	return true
+}
+
+// finishHandshake releases a reservation from
+// startHandshake, queueing the connection for Accept() if
+// the handshake succeeded.
+//
+// If the accept queue is full, the connection is reset.
+func (t *tcp4Listener) finishHandshake(conn *tcp4Conn) {
+	t.pendingLock.Lock()
+	defer t.pendingLock.Unlock()
+	if conn != nil {
+		select {
+		case t.conns <- conn:
+		default:
+			conn.sendReset()
+			conn.fail(ConnectionResetErr)
 		}
-		go conn.loop()
-		t.conns <- conn
 	}
+	t.pending--
+	t.handshakes.Done()
 }
 
 type tcp4Conn struct {
@@ -161,7 +481,94 @@ type tcp4Conn struct {
 	recv tcpRecv
 	send tcpSend
 
-	ttl int
+	localWinScale  uint8
+	remoteWinScale uint8
+
+	sack bool
+	ecn  bool
+
+	ttl      int
+	ackDelay time.Duration
+	clock    Clock
+
+	// challenges limits the rate of challenge ACKs.
+	challenges *rateLimiter
+
+	stateLock sync.Mutex
+	state     TCPState
+
+	keepAlive *tcpKeepAliveTimer
+
+	lingerLock sync.Mutex
+	linger     time.Duration
+
+	// abort is closed to make the loop reset the
+	// connection.
+	abort     chan struct{}
+	abortOnce sync.Once
+
+	// closed is closed once Close() is called, after which
+	// the connection only waits so long in FIN-WAIT-2.
+	closed     chan struct{}
+	closedOnce sync.Once
+
+	// Only accessed by the loop.
+	timeWait   Timer
+	finWait2   Timer
+	delayedAck Timer
+	unacked    int
+
+	// If non-nil, the timestamps option is used.
+	// Only accessed by the loop.
+	timestamps *tcpTimestamps
+
+	// If echoECE is set, outgoing ACKs carry ECE, since
+	// congestion was experienced and the remote end has
+	// not yet responded with CWR.
+	echoECE bool
+}
+
+// newTCP4Conn creates a connection after a handshake.
+// The config must have defaults filled in.
+func newTCP4Conn(stream Stream, laddr, raddr *net.TCPAddr, handshake *tcpHandshake,
+	config *TCPConfig) *tcp4Conn {
+	mss := handshake.mss
+	if handshake.timestamps != nil {
+		// Every segment carries the timestamps option.
+		mss -= tcpTimestampsSize
+	}
+	send := newSimpleTcpSend(handshake.localSeq, handshake.remoteWinSize, mss, config)
+	send.timestampRTT = handshake.timestamps != nil
+	if handshake.rtt != 0 {
+		send.rto.AddSample(handshake.rtt)
+	}
+	return &tcp4Conn{
+		stream: stream,
+		laddr:  laddr,
+		raddr:  raddr,
+		recv:   newSimpleTcpRecv(handshake.remoteSeq, config.RecvBuffer, config.Clock),
+		send:   send,
+
+		localWinScale:  handshake.localWinScale,
+		remoteWinScale: handshake.remoteWinScale,
+
+		sack:       handshake.sack,
+		ecn:        handshake.ecn,
+		timestamps: handshake.timestamps,
+
+		ttl:      config.TTL,
+		ackDelay: config.AckDelay,
+		clock:    config.Clock,
+
+		challenges: newRateLimiter(tcpMaxChallengeAckRate, config.Clock),
+		state:      TCPEstablished,
+
+		keepAlive: newTCPKeepAliveTimer(config.KeepAlive, config.Clock),
+
+		linger: -1,
+		abort:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
 }
 
 func (t *tcp4Conn) Read(b []byte) (int, error) {
@@ -172,6 +579,14 @@ func (t *tcp4Conn) Write(b []byte) (int, error) {
 	return t.send.Write(b)
 }
 
+func (t *tcp4Conn) WriteUrgent(b []byte) (int, error) {
+	return t.send.WriteUrgent(b)
+}
+
+func (t *tcp4Conn) UrgentOffset() (int, bool) {
+	return t.recv.UrgentOffset()
+}
+
 func (t *tcp4Conn) LocalAddr() net.Addr {
 	return t.laddr
 }
@@ -196,84 +611,512 @@ func (t *tcp4Conn) SetWriteDeadline(d time.Time) error {
 	return nil
 }
 
+// Close shuts down both sides of the connection.
+// See SetLinger for how it handles the FIN handshake.
+//
+// Once our FIN is acknowledged, the connection is reset
+// if the remote end does not send its own FIN within
+// tcpFinWait2Timeout.
 func (t *tcp4Conn) Close() error {
-	return t.send.Close()
+	t.closedOnce.Do(func() {
+		close(t.closed)
+	})
+	t.CloseRead()
+
+	t.lingerLock.Lock()
+	linger := t.linger
+	t.lingerLock.Unlock()
+
+	if linger == 0 {
+		t.reset()
+		return nil
+	}
+	if err := t.CloseWrite(); err != nil {
+		return err
+	}
+	if linger < 0 {
+		return nil
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		res <- t.send.Wait()
+	}()
+	timer := t.clock.NewTimer(linger)
+	defer timer.Stop()
+	select {
+	case err := <-res:
+		return err
+	case <-timer.Chan():
+		t.reset()
+		return lingerTimeoutErr
+	}
+}
+
+func (t *tcp4Conn) CloseRead() error {
+	t.recv.CloseRead()
+	return nil
+}
+
+func (t *tcp4Conn) CloseWrite() error {
+	return t.send.CloseWrite()
+}
+
+func (t *tcp4Conn) RTT() time.Duration {
+	return t.send.RTT()
+}
+
+func (t *tcp4Conn) RecoveryStats() TCPRecoveryStats {
+	return t.send.RecoveryStats()
+}
+
+func (t *tcp4Conn) SetCongestionControl(cc CongestionControl) {
+	t.send.SetCongestionControl(cc)
+}
+
+func (t *tcp4Conn) SetKeepAliveConfig(config TCPKeepAlive) {
+	t.keepAlive.SetConfig(config)
+}
+
+func (t *tcp4Conn) SetNoDelay(noDelay bool) error {
+	t.send.SetNoDelay(noDelay)
+	return nil
+}
+
+func (t *tcp4Conn) SetLinger(sec int) error {
+	t.lingerLock.Lock()
+	defer t.lingerLock.Unlock()
+	if sec < 0 {
+		t.linger = -1
+	} else {
+		t.linger = time.Duration(sec) * time.Second
+	}
+	return nil
+}
+
+func (t *tcp4Conn) State() TCPState {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.state
+}
+
+func (t *tcp4Conn) setState(state TCPState) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	t.state = state
 }
 
 func (t *tcp4Conn) loop() {
-	for !t.send.Done() || !t.recv.Done() {
+	defer t.stream.Close()
+	defer t.keepAlive.Stop()
+	for t.State() != TCPClosed {
+		var timeWait, finWait2, delayedAck <-chan time.Time
+		if t.timeWait != nil {
+			timeWait = t.timeWait.Chan()
+		}
+		if t.finWait2 != nil {
+			finWait2 = t.finWait2.Chan()
+		}
+		if t.delayedAck != nil {
+			delayedAck = t.delayedAck.Chan()
+		}
+		var closed <-chan struct{}
+		if t.State() == TCPFinWait2 && t.finWait2 == nil {
+			closed = t.closed
+		}
 		select {
 		case outgoing := <-t.send.Next():
 			t.sendSegment(outgoing)
+			if outgoing.Fin {
+				t.handleFinSent()
+			}
 		case <-t.recv.WindowOpen():
 			t.sendAck()
+		case <-timeWait:
+			t.setState(TCPClosed)
+		case <-closed:
+			t.finWait2 = t.clock.NewTimer(tcpFinWait2Timeout)
+		case <-finWait2:
+			// The remote end may be gone for good.
+			t.sendReset()
+			t.fail(finWait2TimeoutErr)
+		case <-delayedAck:
+			t.delayedAck = nil
+			t.sendAck()
+		case <-t.keepAlive.Changed():
+			if t.State() != TCPTimeWait {
+				t.keepAlive.Restart()
+			}
+		case <-t.keepAlive.Chan():
+			t.handleKeepAlive()
+		case <-t.send.TimedOut():
+			t.sendReset()
+			t.fail(retransmitTimeoutErr)
+		case <-t.abort:
+			t.sendReset()
+			t.fail(io.ErrClosedPipe)
 		case packet := <-t.stream.Incoming():
 			if packet == nil {
+				t.fail(io.ErrClosedPipe)
 				return
 			}
-			tp := TCP4Packet(packet)
-			segment := &tcpSegment{
-				Start: tp.Header().SeqNum(),
-				Data:  tp.Payload(),
-				Fin:   tp.Header().Flag(FIN),
-			}
-			t.recv.Handle(segment)
-			t.send.Handle(tp.Header().AckNum(), tp.Header().WindowSize())
-			if len(segment.Data) > 0 {
-				t.sendAck()
-			}
+			t.keepAlive.Activity()
+			t.handlePacket(TCP4Packet(packet))
+		}
+		t.advance()
+	}
+	if t.timeWait != nil {
+		t.timeWait.Stop()
+	}
+	if t.finWait2 != nil {
+		t.finWait2.Stop()
+	}
+	t.stopDelayedAck()
+}
+
+func (t *tcp4Conn) handlePacket(tp TCP4Packet) {
+	header := tp.Header()
+
+	// As described in RFC 5961, a blind attacker must
+	// guess the exact sequence number to reset the
+	// connection. The real peer answers a challenge ACK
+	// with a RST that has the right sequence number.
+	if header.Flag(RST) {
+		if header.SeqNum() == t.recv.Ack() {
+			t.fail(ConnectionResetErr)
+		} else if t.inWindow(header.SeqNum()) {
+			t.sendChallengeAck()
+		}
+		return
+	}
+	if header.Flag(SYN) {
+		// A retransmitted SYN means that our handshake ACK
+		// was probably lost, which the challenge ACK fixes.
+		// Otherwise, the peer may have restarted, and will
+		// reset the connection in response.
+		t.sendChallengeAck()
+		return
+	}
+	if t.State() == TCPTimeWait {
+		// The remote end may not have seen our final ACK.
+		if header.Flag(FIN) {
+			t.sendAck()
+			t.timeWait.Reset(2 * tcpMSL)
+		}
+		return
+	}
+
+	var tsVal, tsEcr uint32
+	if t.timestamps != nil {
+		var ok bool
+		tsVal, tsEcr, ok = tcpTimestampsOption(header)
+		if !ok {
+			// RFC 7323 requires every segment to carry a
+			// timestamp once they are negotiated.
+			return
+		}
+		if !t.timestamps.Check(tsVal) {
+			// PAWS rejects old duplicates, even if their
+			// sequence numbers have wrapped into the window.
+			t.sendAck()
+			return
+		}
+	}
+
+	segLen := uint32(len(tp.Payload()))
+	if header.Flag(FIN) {
+		segLen++
+	}
+	if !t.acceptable(header.SeqNum(), segLen) {
+		// Old segments, such as keepalive probes, and
+		// segments beyond the window are acknowledged and
+		// otherwise ignored.
+		t.sendAck()
+		return
+	}
+	if t.timestamps != nil {
+		t.timestamps.Update(header.SeqNum(), tsVal)
+		if rtt, ok := t.timestamps.RTT(tsEcr); ok {
+			t.send.HandleTimestampRTT(header.AckNum(), rtt)
+		}
+	}
+
+	segment := &tcpSegment{
+		Start: header.SeqNum(),
+		Data:  tp.Payload(),
+		Fin:   header.Flag(FIN),
+	}
+	if header.Flag(URG) {
+		segment.Urgent = uint32(header.UrgPointer())
+	}
+	var congested bool
+	if t.ecn {
+		if header.Flag(CWR) {
+			t.echoECE = false
+		}
+		if IPv4Packet(tp).ECN() == ECNCE {
+			t.echoECE = true
+			congested = true
+		}
+		if header.Flag(ECE) {
+			t.send.HandleECE()
 		}
 	}
-	t.stream.Close()
+	ack := t.recv.Ack()
+	gap := len(t.recv.SACKBlocks(1)) > 0
+	t.recv.Handle(segment)
+	window := uint32(header.WindowSize()) << t.remoteWinScale
+	t.send.Handle(header.AckNum(), window, t.sackBlocks(header),
+		len(segment.Data) > 0 || segment.Fin)
+
+	// Only data which arrives in order may be acknowledged
+	// late. Out-of-order or rejected data, data which
+	// fills a gap, FINs, and congestion marks are
+	// acknowledged immediately.
+	inOrder := segment.Start == ack && t.recv.Ack() != ack && !gap
+	if len(segment.Data) > 0 && inOrder && !segment.Fin && !congested {
+		t.delayAck()
+	} else if len(segment.Data) > 0 || segment.Fin {
+		t.sendAck()
+	}
+}
+
+// handleFinSent updates the state after our FIN has been
+// sent.
+func (t *tcp4Conn) handleFinSent() {
+	switch t.State() {
+	case TCPEstablished:
+		t.setState(TCPFinWait1)
+	case TCPCloseWait:
+		t.setState(TCPLastAck)
+	}
+}
+
+// advance moves through the closing states as the sender
+// and receiver finish.
+func (t *tcp4Conn) advance() {
+	state := t.State()
+	if t.send.Done() {
+		switch state {
+		case TCPFinWait1:
+			state = TCPFinWait2
+		case TCPClosing:
+			state = TCPTimeWait
+		case TCPLastAck:
+			state = TCPClosed
+		}
+	}
+	if t.recv.Done() {
+		switch state {
+		case TCPEstablished:
+			state = TCPCloseWait
+		case TCPFinWait1:
+			state = TCPClosing
+		case TCPFinWait2:
+			state = TCPTimeWait
+		}
+	}
+	if state == TCPTimeWait && t.timeWait == nil {
+		t.timeWait = t.clock.NewTimer(2 * tcpMSL)
+		t.keepAlive.Stop()
+	}
+	if state != TCPFinWait2 && t.finWait2 != nil {
+		t.finWait2.Stop()
+		t.finWait2 = nil
+	}
+	t.setState(state)
+}
+
+func (t *tcp4Conn) handleKeepAlive() {
+	probe, err := t.keepAlive.Expire()
+	if err != nil {
+		t.sendReset()
+		t.fail(err)
+	} else if probe {
+		// The probe carries an old sequence number, forcing
+		// the remote end to respond with an ACK.
+		packet := NewTCP4PacketOptions(t.ttl, t.laddr, t.raddr, t.send.Seq()-1,
+			t.recv.Ack(), t.window(), t.timestampOptions(), nil, ACK)
+		Send(t.stream, packet)
+	}
+}
+
+// reset aborts the connection with a RST, discarding
+// any unsent data, and waits for the loop to exit.
+func (t *tcp4Conn) reset() {
+	t.abortOnce.Do(func() {
+		close(t.abort)
+	})
+	<-t.stream.Done()
+}
+
+// fail aborts the connection, causing all reads and
+// writes to fail with err.
+func (t *tcp4Conn) fail(err error) {
+	t.send.Fail(err)
+	t.recv.Fail(err)
+	t.setState(TCPClosed)
+}
+
+// inWindow checks if a sequence number is within the
+// receive window.
+func (t *tcp4Conn) inWindow(seq uint32) bool {
+	ack := t.recv.Ack()
+	window := t.recv.Window()
+	if window == 0 {
+		return seq == ack
+	}
+	return !tcpSeqLess(seq, ack) && tcpSeqLess(seq, ack+window)
+}
+
+// acceptable performs the segment acceptability test
+// from RFC 793 on a segment's sequence number and
+// length, including any FIN.
+//
+// As RFC 793 allows, a segment at the start of a zero
+// window is accepted so that its ACK is processed; any
+// data is then dropped by the receiver.
+func (t *tcp4Conn) acceptable(seq, length uint32) bool {
+	if length == 0 || t.recv.Window() == 0 {
+		return t.inWindow(seq)
+	}
+	return t.inWindow(seq) || t.inWindow(seq+length-1)
+}
+
+// delayAck acknowledges every second segment right away,
+// and schedules an ACK for other segments in case no
+// outgoing data can carry it.
+func (t *tcp4Conn) delayAck() {
+	t.unacked++
+	if t.unacked >= 2 || t.ackDelay < 0 {
+		t.sendAck()
+	} else if t.delayedAck == nil {
+		t.delayedAck = t.clock.NewTimer(t.ackDelay)
+	}
+}
+
+// stopDelayedAck is called whenever an outgoing segment
+// acknowledges all received data.
+func (t *tcp4Conn) stopDelayedAck() {
+	t.unacked = 0
+	if t.delayedAck != nil {
+		t.delayedAck.Stop()
+		t.delayedAck = nil
+	}
 }
 
 func (t *tcp4Conn) sendAck() {
-	packet := NewTCP4Packet(t.ttl, t.laddr, t.raddr, t.send.Seq(), t.recv.Ack(), t.recv.Window(),
-		nil, ACK)
-	select {
-	case t.stream.Outgoing() <- packet:
-	default:
+	t.stopDelayedAck()
+	// SACK blocks are only sent on bare ACKs, so that
+	// data segments never exceed the MSS.
+	options := t.timestampOptions()
+	maxBlocks := tcpMaxSACKBlocks
+	if t.timestamps != nil {
+		maxBlocks = tcpMaxSACKBlocksTimestamps
+	}
+	if t.sack {
+		if blocks := t.recv.SACKBlocks(maxBlocks); len(blocks) > 0 {
+			options = append(options, &TCPOption{Kind: TCPOptionNop},
+				&TCPOption{Kind: TCPOptionNop}, NewTCPOptionSACK(blocks))
+		}
 	}
+	packet := NewTCP4PacketOptions(t.ttl, t.laddr, t.raddr, t.send.Seq(), t.recv.Ack(),
+		t.window(), options, nil, t.ackFlags()...)
+	Send(t.stream, packet)
+}
+
+// sendChallengeAck sends an ACK in response to a
+// suspicious RST or SYN, at a limited rate.
+func (t *tcp4Conn) sendChallengeAck() {
+	if t.challenges.Allow() {
+		t.sendAck()
+	}
+}
+
+func (t *tcp4Conn) sendReset() {
+	packet := NewTCP4Packet(t.ttl, t.laddr, t.raddr, t.send.Seq(), t.recv.Ack(), 0, nil,
+		RST, ACK)
+	Send(t.stream, packet)
 }
 
 func (t *tcp4Conn) sendSegment(seg *tcpSegment) {
-	packet := NewTCP4Packet(t.ttl, t.laddr, t.raddr, seg.Start, t.recv.Ack(), t.recv.Window(),
-		seg.Data, ACK)
+	t.stopDelayedAck()
+	flags := t.ackFlags()
 	if seg.Fin {
-		packet.Header().SetFlag(FIN, true)
+		flags = append(flags, FIN)
+	}
+	if seg.CWR {
+		flags = append(flags, CWR)
+	}
+	packet := NewTCP4PacketOptions(t.ttl, t.laddr, t.raddr, seg.Start, t.recv.Ack(),
+		t.window(), t.timestampOptions(), seg.Data, flags...)
+	if seg.Urgent != 0 {
+		packet.Header().SetFlag(URG, true)
+		packet.Header().SetUrgPointer(uint16(essentials.MinInt(int(seg.Urgent), 0xffff)))
 		packet.SetChecksum()
 	}
-	select {
-	case t.stream.Outgoing() <- packet:
-	default:
+	if t.ecn && len(seg.Data) > 0 && !seg.Retransmit {
+		// Retransmissions and pure ACKs are never marked
+		// as ECN-capable, following RFC 3168.
+		IPv4Packet(packet).SetECN(ECNECT0)
+		IPv4Packet(packet).SetChecksum()
 	}
+	Send(t.stream, packet)
 }
 
-func filterTCP4Dest(s Stream, addr *net.TCPAddr) Stream {
-	return Filter(s, func(packet []byte) []byte {
-		tp := TCP4Packet(packet)
-		if !tp.DestAddr().IP.Equal(addr.IP) || tp.DestAddr().Port != addr.Port {
-			return nil
-		}
-		return packet
-	}, nil)
+// timestampOptions gets the options for an outgoing
+// segment other than a RST.
+func (t *tcp4Conn) timestampOptions() []*TCPOption {
+	if t.timestamps == nil {
+		return nil
+	}
+	return []*TCPOption{{Kind: TCPOptionNop}, {Kind: TCPOptionNop},
+		t.timestamps.Option(t.recv.Ack())}
 }
 
-func filterTCP4Source(s Stream, addr *net.TCPAddr) Stream {
-	return Filter(s, func(packet []byte) []byte {
-		tp := TCP4Packet(packet)
-		if !tp.SourceAddr().IP.Equal(addr.IP) || tp.SourceAddr().Port != addr.Port {
-			return nil
-		}
-		return packet
-	}, nil)
+// ackFlags gets the flags for an outgoing segment which
+// acknowledges incoming data.
+func (t *tcp4Conn) ackFlags() []Flag {
+	if t.echoECE {
+		return []Flag{ACK, ECE}
+	}
+	return []Flag{ACK}
 }
 
-func filterTCP4Syn(s Stream) Stream {
-	return Filter(s, func(packet []byte) []byte {
-		if TCP4Packet(packet).Header().Flag(SYN) {
-			return packet
-		}
+// sackBlocks reads the SACK blocks from an incoming
+// packet, if SACK is enabled.
+func (t *tcp4Conn) sackBlocks(header TCPHeader) []TCPSACKBlock {
+	if !t.sack {
 		return nil
-	}, nil)
+	}
+	options, err := header.TCPOptions()
+	if err != nil {
+		return nil
+	}
+	for _, option := range options {
+		if blocks, ok := option.SACKBlocks(); ok {
+			return blocks
+		}
+	}
+	return nil
+}
+
+// window computes the scaled window field for outgoing
+// packets.
+func (t *tcp4Conn) window() uint16 {
+	return tcpScaleWindow(t.recv.Window(), t.localWinScale)
+}
+
+// tcp4DemuxKey gets the key of the connection which an
+// incoming segment belongs to.
+func tcp4DemuxKey(packet []byte) demuxKey {
+	header := TCP4Packet(packet).Header()
+	return newDemuxKey(int(header.DestPort()), IPv4Packet(packet).SourceAddr(),
+		int(header.SourcePort()))
+}
+
+// tcpIsSyn checks if a segment is the SYN which begins a
+// passive open.
+func tcpIsSyn(header TCPHeader) bool {
+	return header.Flag(SYN) && !header.Flag(ACK) && !header.Flag(RST)
 }
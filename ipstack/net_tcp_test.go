@@ -0,0 +1,673 @@
+package ipstack
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+func TestTCPDialListen(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(0, nil)
+	testTCPEcho(t, clientNet, serverNet, bytes.Repeat([]byte("hello, world! "), 500))
+}
+
+func TestTCPLargeWindow(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(1<<20, nil)
+	message := make([]byte, 1<<20)
+	rand.Read(message)
+	testTCPEcho(t, clientNet, serverNet, message)
+}
+
+func TestTCPCUBIC(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(1<<20, NewCUBICController)
+	message := make([]byte, 1<<20)
+	rand.Read(message)
+	testTCPEcho(t, clientNet, serverNet, message)
+}
+
+func TestTCPStates(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(0, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	client, server := newTestTCPConns(t, clientNet, serverNet)
+
+	waitTCPState(t, client, TCPEstablished)
+	waitTCPState(t, server, TCPEstablished)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected EOF but got", err)
+	}
+	waitTCPState(t, client, TCPFinWait2)
+	waitTCPState(t, server, TCPCloseWait)
+
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitTCPState(t, client, TCPTimeWait)
+	waitTCPState(t, server, TCPClosed)
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(0, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	client, server := newTestTCPConns(t, clientNet, serverNet)
+
+	var conn TCPConn = client
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected EOF but got", err)
+	}
+	if _, err := server.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(client, data); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "reply" {
+		t.Fatal("unexpected data:", string(data))
+	}
+
+	if err := client.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(data); err != io.EOF {
+		t.Fatal("expected EOF but got", err)
+	}
+	// Data is still acknowledged after CloseRead.
+	if _, err := server.Write([]byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close succeeds once the FIN is already queued.
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("late")); err != io.ErrClosedPipe {
+		t.Fatal("expected closed pipe but got", err)
+	}
+}
+
+func TestTCPConfig(t *testing.T) {
+	clientStream, serverStream := Pipe(100)
+	clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil,
+		&TCPConfig{MSS: 1000})
+	serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+
+	serverAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	listener, err := serverNet.ListenTCPConfig(serverAddr, &TCPConfig{
+		MSS:        500,
+		RecvBuffer: 5000,
+		MinRTO:     time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := clientNet.DialTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := conn.(*tcp4Conn), accepted.(*tcp4Conn)
+
+	clientSend, serverSend := client.send.(*simpleTcpSend), server.send.(*simpleTcpSend)
+	if clientSend.maxSegmentSize != 500 || serverSend.maxSegmentSize != 500 {
+		t.Error("unexpected MSS", clientSend.maxSegmentSize, serverSend.maxSegmentSize)
+	}
+	if clientSend.window != 5000 {
+		t.Error("unexpected window", clientSend.window)
+	}
+	if rto := serverSend.rto.RTO(); rto != time.Second {
+		t.Error("unexpected RTO", rto)
+	}
+	if rto := clientSend.rto.RTO(); rto >= time.Second {
+		t.Error("unexpected RTO", rto)
+	}
+}
+
+func TestTCPUrgent(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(0, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	client, server := newTestTCPConns(t, clientNet, serverNet)
+
+	if _, err := client.Write([]byte("normal")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteUrgent([]byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if n, ok := server.UrgentOffset(); ok {
+			if n != 7 {
+				t.Fatal("unexpected urgent offset", n)
+			}
+			break
+		} else if i == 100 {
+			t.Fatal("urgent data never arrived")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Reads stop at the end of the urgent data.
+	client.Write([]byte("more"))
+	data := make([]byte, 100)
+	var received []byte
+	for len(received) < 7 {
+		n, err := server.Read(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, data[:n]...)
+	}
+	if string(received) != "normal!" {
+		t.Fatal("unexpected data", string(received))
+	}
+	if _, ok := server.UrgentOffset(); ok {
+		t.Fatal("urgent data should have been read")
+	}
+}
+
+func TestTCPECN(t *testing.T) {
+	clientStream, serverStream := Pipe(100)
+
+	// Routers mark the first ECN-capable data segment with
+	// Congestion Experienced.
+	var marked, cwr int32
+	serverStream = Filter(serverStream, func(packet []byte) []byte {
+		ip := IPv4Packet(packet)
+		if len(TCP4Packet(packet).Payload()) > 0 {
+			if ip.ECN() != ECNECT0 {
+				t.Error("data segment is not ECN-capable")
+			} else if atomic.CompareAndSwapInt32(&marked, 0, 1) {
+				ip.SetECN(ECNCE)
+				ip.SetChecksum()
+			}
+		}
+		if header := TCP4Packet(packet).Header(); header.Flag(CWR) && !header.Flag(SYN) {
+			atomic.AddInt32(&cwr, 1)
+		}
+		return packet
+	}, nil)
+	config := &TCPConfig{ECN: true, NoDelay: true}
+	clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil, config)
+	serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, config)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	client, server := newTestTCPConns(t, clientNet, serverNet)
+	if !client.ecn || !server.ecn {
+		t.Fatal("ECN was not negotiated")
+	}
+
+	data := make([]byte, 10)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(server, data); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	congestion := client.send.(*simpleTcpSend).congestion
+	if congestion.SlowStartThreshold() == math.MaxInt32 {
+		t.Error("congestion window was not reduced")
+	}
+	if n := atomic.LoadInt32(&cwr); n != 1 {
+		t.Error("expected one CWR but got", n)
+	}
+	if server.echoECE {
+		t.Error("ECE is still being echoed")
+	}
+}
+
+func TestTCPReset(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(0, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	client, server := newTestTCPConns(t, clientNet, serverNet)
+
+	server.sendReset()
+	if _, err := client.Read(make([]byte, 1)); err != ConnectionResetErr {
+		t.Fatal("expected reset but got", err)
+	}
+	if _, err := client.Write([]byte("hi")); err != ConnectionResetErr {
+		t.Fatal("expected reset but got", err)
+	}
+	waitTCPState(t, client, TCPClosed)
+}
+
+func TestTCPLinger(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		clientStream, serverStream := Pipe(100)
+		var dropping int32
+		serverStream = Filter(serverStream, func(packet []byte) []byte {
+			if atomic.LoadInt32(&dropping) != 0 {
+				return nil
+			}
+			return packet
+		}, nil)
+		clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil, nil)
+		serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, nil)
+		defer clientNet.Close()
+		defer serverNet.Close()
+		client, _ := newTestTCPConns(t, clientNet, serverNet)
+
+		// Close returns without waiting for the peer.
+		atomic.StoreInt32(&dropping, 1)
+		client.Write([]byte("hello"))
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		waitTCPState(t, client, TCPFinWait1)
+	})
+
+	t.Run("BlockedWrite", func(t *testing.T) {
+		clientStream, serverStream := Pipe(100)
+		var dropping int32
+		serverStream = Filter(serverStream, func(packet []byte) []byte {
+			if atomic.LoadInt32(&dropping) != 0 {
+				return nil
+			}
+			return packet
+		}, nil)
+		clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil,
+			&TCPConfig{SendBuffer: 10})
+		serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, nil)
+		defer clientNet.Close()
+		defer serverNet.Close()
+		client, _ := newTestTCPConns(t, clientNet, serverNet)
+
+		// The write blocks, since nothing is acknowledged.
+		atomic.StoreInt32(&dropping, 1)
+		res := make(chan error, 1)
+		go func() {
+			_, err := client.Write(make([]byte, 100))
+			res <- err
+		}()
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-res:
+			if err != io.ErrClosedPipe {
+				t.Fatal("expected closed pipe but got", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("write did not return")
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		clientNet, serverNet := newTestTCPNets(0, nil)
+		defer clientNet.Close()
+		defer serverNet.Close()
+		client, server := newTestTCPConns(t, clientNet, serverNet)
+
+		client.SetLinger(0)
+		client.Write([]byte("hello"))
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if state := client.State(); state != TCPClosed {
+			t.Fatal("unexpected state:", state)
+		}
+		for {
+			if _, err := server.Read(make([]byte, 16)); err != nil {
+				if err != ConnectionResetErr {
+					t.Fatal("expected reset but got", err)
+				}
+				break
+			}
+		}
+		waitTCPState(t, server, TCPClosed)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		clientStream, serverStream := Pipe(100)
+		var dropping int32
+		serverStream = Filter(serverStream, func(packet []byte) []byte {
+			if atomic.LoadInt32(&dropping) != 0 {
+				return nil
+			}
+			return packet
+		}, nil)
+		clock := NewManualClock(time.Unix(0, 0))
+		clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil,
+			&TCPConfig{Clock: clock})
+		serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, nil)
+		defer clientNet.Close()
+		defer serverNet.Close()
+		client, _ := newTestTCPConns(t, clientNet, serverNet)
+
+		atomic.StoreInt32(&dropping, 1)
+		client.SetLinger(1)
+		res := make(chan error, 1)
+		go func() {
+			res <- client.Close()
+		}()
+
+		// Wait for the FIN's retransmission timer and the
+		// linger timer.
+		clock.WaitTimers(2)
+		clock.Advance(time.Second - time.Millisecond)
+		select {
+		case err := <-res:
+			t.Fatal("close returned early:", err)
+		default:
+		}
+		waitTCPState(t, client, TCPFinWait1)
+
+		clock.Advance(time.Millisecond)
+		select {
+		case err := <-res:
+			if err != lingerTimeoutErr {
+				t.Fatal("expected timeout but got", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("close did not time out")
+		}
+		if state := client.State(); state != TCPClosed {
+			t.Fatal("unexpected state:", state)
+		}
+	})
+}
+
+func TestTCPDelayedAck(t *testing.T) {
+	clientStream, serverStream := Pipe(100)
+	var counting, acks int32
+	serverStream = Filter(serverStream, nil, func(packet []byte) []byte {
+		tp := TCP4Packet(packet)
+		if atomic.LoadInt32(&counting) != 0 && len(tp.Payload()) == 0 {
+			atomic.AddInt32(&acks, 1)
+		}
+		return packet
+	})
+	clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil, nil)
+	serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	client, server := newTestTCPConns(t, clientNet, serverNet)
+
+	atomic.StoreInt32(&counting, 1)
+	const numSegments = 8
+	data := make([]byte, numSegments*(DefaultMTU-40))
+	go client.Write(data)
+	if _, err := io.ReadFull(server, data); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(DefaultTCPAckDelay * 2)
+	if n := atomic.LoadInt32(&acks); n == 0 || n > numSegments/2 {
+		t.Fatalf("expected at most %d ACKs but got %d", numSegments/2, n)
+	}
+}
+
+func TestTCPConnectionRefused(t *testing.T) {
+	clientNet, serverNet := newTestTCPNets(0, nil)
+	defer clientNet.Close()
+	defer serverNet.Close()
+	_, err := clientNet.DialTCP(&net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337})
+	if ctxErr, ok := err.(*essentials.CtxError); !ok || ctxErr.Original != ConnectionRefusedErr {
+		t.Fatal("expected connection refused but got", err)
+	}
+}
+
+func TestTCPListenerBacklog(t *testing.T) {
+	clientStream, serverStream := Pipe(100)
+	clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil, nil)
+	serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil,
+		&TCPConfig{Backlog: 2})
+	defer clientNet.Close()
+	defer serverNet.Close()
+
+	serverAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	l, err := serverNet.ListenTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := l.(*tcp4Listener)
+
+	// A peer which never completes its handshake.
+	silentAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 3}, Port: 1000}
+	Send(clientStream, NewTCP4Packet(64, silentAddr, serverAddr, 0, 0, 1024, nil, SYN))
+
+	conn, err := clientNet.DialTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := listener.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill up the backlog.
+	silentAddr.Port++
+	Send(clientStream, NewTCP4Packet(64, silentAddr, serverAddr, 0, 0, 1024, nil, SYN))
+	silentAddr.Port++
+	Send(clientStream, NewTCP4Packet(64, silentAddr, serverAddr, 0, 0, 1024, nil, SYN))
+	time.Sleep(time.Millisecond * 100)
+	listener.pendingLock.Lock()
+	pending := listener.pending
+	listener.pendingLock.Unlock()
+	if pending != 2 {
+		t.Fatal("unexpected number of pending handshakes:", pending)
+	}
+}
+
+func TestTCPSYNCookies(t *testing.T) {
+	clientStream, serverStream := Pipe(100)
+	clientNet := NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil, nil)
+	serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil,
+		&TCPConfig{Backlog: 1, SYNCookies: true})
+	defer clientNet.Close()
+	defer serverNet.Close()
+
+	serverAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	l, err := serverNet.ListenTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := l.(*tcp4Listener)
+
+	// Fill up the backlog with a peer which never
+	// completes its handshake.
+	silentAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 3}, Port: 1000}
+	Send(clientStream, NewTCP4Packet(64, silentAddr, serverAddr, 0, 0, 1024, nil, SYN))
+	for {
+		listener.pendingLock.Lock()
+		pending := listener.pending
+		listener.pendingLock.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client, err := clientNet.DialTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := conn.(*tcp4Conn); server.sack || server.remoteWinScale != 0 {
+		t.Error("options should not be used with SYN cookies")
+	}
+
+	go client.Write([]byte("hello, world!"))
+	data := make([]byte, 13)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello, world!" {
+		t.Fatal("unexpected data:", string(data))
+	}
+}
+
+func TestTCPSYNCookieAck(t *testing.T) {
+	clientStream, serverStream := Pipe(100)
+	serverNet := NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil,
+		&TCPConfig{Backlog: 1, SYNCookies: true})
+	defer serverNet.Close()
+
+	serverAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	l, err := serverNet.ListenTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := l.(*tcp4Listener)
+
+	silentAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 3}, Port: 1000}
+	Send(clientStream, NewTCP4Packet(64, silentAddr, serverAddr, 0, 0, 1024, nil, SYN))
+	for {
+		listener.pendingLock.Lock()
+		pending := listener.pending
+		listener.pendingLock.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clientAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 2000}
+	Send(clientStream, NewTCP4PacketOptions(64, clientAddr, serverAddr, 100, 0, 1024,
+		[]*TCPOption{NewTCPOptionMSS(1300)}, nil, SYN))
+	var synAck TCP4Packet
+	for synAck == nil {
+		select {
+		case packet := <-clientStream.Incoming():
+			if tp := TCP4Packet(packet); int(tp.Header().DestPort()) == clientAddr.Port {
+				synAck = tp
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("no SYN/ACK")
+		}
+	}
+	if mss := parseTCPSynOptions(synAck.Header()).mss; mss != DefaultTCPMSS {
+		t.Error("unexpected advertised MSS", mss)
+	}
+
+	// The final ACK of the handshake carries data.
+	Send(clientStream, NewTCP4Packet(64, clientAddr, serverAddr, 101,
+		synAck.Header().SeqNum()+1, 1024, []byte("hello"), ACK))
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if mss := conn.(*tcp4Conn).send.(*simpleTcpSend).maxSegmentSize; mss != 1300 {
+		t.Error("unexpected MSS", mss)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	data := make([]byte, 5)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatal("unexpected data:", string(data))
+	}
+}
+
+func testTCPEcho(t *testing.T, clientNet, serverNet TCPNet, message []byte) {
+	defer clientNet.Close()
+	defer serverNet.Close()
+
+	serverAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	listener, err := serverNet.ListenTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer conn.Close()
+		data, err := ioutil.ReadAll(conn)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		_, err = conn.Write(data)
+		errChan <- err
+	}()
+
+	conn, err := clientNet.DialTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	echo, err := ioutil.ReadAll(conn)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, message) {
+		t.Fatal("unexpected echo")
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestTCPNets(recvBuf int, cc CongestionControl) (client, server TCPNet) {
+	clientStream, serverStream := Pipe(100)
+	config := &TCPConfig{RecvBuffer: recvBuf, CongestionControl: cc}
+	client = NewTCP4NetConfig(clientStream, net.IP{10, 0, 0, 1}, nil, config)
+	server = NewTCP4NetConfig(serverStream, net.IP{10, 0, 0, 2}, nil, config)
+	return
+}
+
+func newTestTCPConns(t *testing.T, clientNet, serverNet TCPNet) (client, server *tcp4Conn) {
+	serverAddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+	listener, err := serverNet.ListenTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := clientNet.DialTCP(serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*tcp4Conn), accepted.(*tcp4Conn)
+}
+
+func waitTCPState(t *testing.T, conn *tcp4Conn, state TCPState) {
+	timeout := time.After(time.Second * 5)
+	for conn.State() != state {
+		select {
+		case <-timeout:
+			t.Fatalf("expected state %s but got %s", state, conn.State())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -25,11 +25,12 @@ type UDPNet interface {
 }
 
 type udp4Net struct {
-	multi      MultiStream
+	demux      *demuxTable
 	laddr      net.IP
 	ports      PortAllocator
 	ttl        int
 	readBuffer int
+	clock      Clock
 }
 
 // NewUDP4Net creates a UDPNet on top of a Stream.
@@ -50,7 +51,11 @@ type udp4Net struct {
 //
 // The readBuf argument is the packet read buffer size.
 // If 0, DefaultUDPReadBuffer is used.
-func NewUDP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl, readBuf int) UDPNet {
+//
+// The clock is used for read and write deadlines.
+// If nil, SystemClock() is used.
+func NewUDP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl, readBuf int,
+	clock Clock) UDPNet {
 	if ports == nil {
 		ports = BasicPortAllocator()
 	}
@@ -60,6 +65,9 @@ func NewUDP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl, readBuf i
 	if readBuf == 0 {
 		readBuf = DefaultUDPReadBuffer
 	}
+	if clock == nil {
+		clock = SystemClock()
+	}
 	stream = FilterIPv4Proto(stream, ProtocolNumberUDP)
 	stream = FilterIPv4Dest(stream, laddr)
 	stream = Filter(stream, func(packet []byte) []byte {
@@ -70,109 +78,90 @@ func NewUDP4Net(stream Stream, laddr net.IP, ports PortAllocator, ttl, readBuf i
 		return nil
 	}, nil)
 	return &udp4Net{
-		multi:      Multiplex(stream),
+		demux:      newDemuxTable(stream, udp4DemuxKey),
 		laddr:      laddr,
 		ports:      ports,
 		ttl:        ttl,
 		readBuffer: readBuf,
+		clock:      clock,
 	}
 }
 
 func (u *udp4Net) DialUDP(laddr, raddr *net.UDPAddr) (conn UDPConn, err error) {
 	defer essentials.AddCtxTo("dial UDP", &err)
 
-	stream, err := u.multi.Fork(u.readBuffer)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err != nil {
-			stream.Close()
-		}
-	}()
-
 	if raddr.IP == nil || raddr.IP.IsUnspecified() {
 		raddr.IP = u.laddr
 	}
-	if laddr == nil {
-		laddr = &net.UDPAddr{IP: u.laddr}
-		if laddr.Port, err = u.ports.AllocRemote(raddr); err != nil {
-			return nil, err
+	if laddr != nil {
+		if !laddr.IP.Equal(u.laddr) {
+			return nil, errors.New("cannot listen on address: " + laddr.String())
 		}
-		go func() {
-			<-stream.Done()
-			u.ports.FreeRemote(raddr, laddr.Port)
-		}()
+		return u.newConn(laddr, raddr, newDemuxKey(laddr.Port, raddr.IP, raddr.Port))
 	}
 
-	if !laddr.IP.Equal(u.laddr) {
-		return nil, errors.New("cannot listen on address: " + laddr.String())
+	laddr = &net.UDPAddr{IP: u.laddr}
+	if laddr.Port, err = u.ports.AllocRemote(raddr); err != nil {
+		return nil, err
 	}
-
-	filtered := Filter(stream, func(d []byte) []byte {
-		source := UDP4Packet(d).SourceAddr()
-		dest := UDP4Packet(d).DestAddr()
-		if !source.IP.Equal(raddr.IP) || source.Port != raddr.Port || dest.Port != laddr.Port {
-			return nil
-		}
-		return d
-	}, nil)
-	return &udp4Conn{
-		streamConn: newStreamConn(filtered),
-		remote:     raddr,
-		local:      laddr,
-		ttl:        u.ttl,
-	}, nil
+	res, err := u.newConn(laddr, raddr, newDemuxKey(laddr.Port, raddr.IP, raddr.Port))
+	if err != nil {
+		u.ports.FreeRemote(raddr, laddr.Port)
+		return nil, err
+	}
+	go func() {
+		<-res.stream.Done()
+		u.ports.FreeRemote(raddr, laddr.Port)
+	}()
+	return res, nil
 }
 
 func (u *udp4Net) ListenUDP(laddr *net.UDPAddr) (conn UDPConn, err error) {
 	defer essentials.AddCtxTo("listen UDP", &err)
 
-	stream, err := u.multi.Fork(u.readBuffer)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		if err != nil {
-			stream.Close()
+	if laddr != nil {
+		if laddr.IP == nil || laddr.IP.IsUnspecified() {
+			laddr.IP = u.laddr
 		}
-	}()
-
-	if laddr == nil {
-		laddr = &net.UDPAddr{IP: u.laddr}
-		if laddr.Port, err = u.ports.AllocAny(); err != nil {
-			return nil, err
+		if !laddr.IP.Equal(u.laddr) {
+			return nil, errors.New("cannot listen on address: " + laddr.String())
 		}
-		go func() {
-			<-stream.Done()
-			u.ports.Free(laddr.Port)
-		}()
-	}
-	if laddr.IP == nil || laddr.IP.IsUnspecified() {
-		laddr.IP = u.laddr
+		return u.newConn(laddr, nil, demuxKey{localPort: laddr.Port})
 	}
 
-	if !laddr.IP.Equal(u.laddr) {
-		return nil, errors.New("cannot listen on address: " + laddr.String())
+	laddr = &net.UDPAddr{IP: u.laddr}
+	if laddr.Port, err = u.ports.AllocAny(); err != nil {
+		return nil, err
+	}
+	res, err := u.newConn(laddr, nil, demuxKey{localPort: laddr.Port})
+	if err != nil {
+		u.ports.Free(laddr.Port)
+		return nil, err
 	}
+	go func() {
+		<-res.stream.Done()
+		u.ports.Free(laddr.Port)
+	}()
+	return res, nil
+}
 
-	filtered := Filter(stream, func(d []byte) []byte {
-		dest := UDP4Packet(d).DestAddr()
-		if dest.Port != laddr.Port {
-			return nil
-		}
-		return d
-	}, nil)
+// newConn creates a socket which receives the packets
+// routed to key.
+func (u *udp4Net) newConn(laddr, raddr *net.UDPAddr, key demuxKey) (*udp4Conn, error) {
+	stream, err := u.demux.Add(key, u.readBuffer)
+	if err != nil {
+		return nil, err
+	}
 	return &udp4Conn{
-		streamConn: newStreamConn(filtered),
-		remote:     nil,
+		streamConn: newStreamConn(stream, u.clock),
+		remote:     raddr,
 		local:      laddr,
 		ttl:        u.ttl,
 	}, nil
 }
 
 func (u *udp4Net) Close() error {
-	return u.multi.Close()
+	return u.demux.Close()
 }
 
 type udp4Conn struct {
@@ -227,3 +216,10 @@ func (u *udp4Conn) LocalAddr() net.Addr {
 func (u *udp4Conn) RemoteAddr() net.Addr {
 	return u.remote
 }
+
+// udp4DemuxKey gets the key of the socket which should
+// receive an incoming packet.
+func udp4DemuxKey(packet []byte) demuxKey {
+	source := UDP4Packet(packet).SourceAddr()
+	return newDemuxKey(UDP4Packet(packet).DestAddr().Port, source.IP, source.Port)
+}
@@ -227,6 +227,7 @@ func (m *multiplexer) Close() error {
 		close(child.done)
 		close(child.incoming)
 	}
+	m.children = nil
 
 	return nil
 }
@@ -3,6 +3,7 @@ package ipstack
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 
@@ -11,6 +12,17 @@ import (
 
 const ProtocolNumberTCP = 6
 
+// These are the kinds of TCPOptions.
+const (
+	TCPOptionEnd         = 0
+	TCPOptionNop         = 1
+	TCPOptionMSS         = 2
+	TCPOptionWindowScale = 3
+	TCPOptionSACKPermit  = 4
+	TCPOptionSACK        = 5
+	TCPOptionTimestamps  = 8
+)
+
 type Flag uint8
 
 const (
@@ -153,16 +165,61 @@ func (t TCPHeader) TCPOptions() ([]*TCPOption, error) {
 		if err != nil {
 			return nil, essentials.AddCtx("TCPOptions", err)
 		}
+		if opt.Kind == TCPOptionEnd {
+			break
+		}
 		res = append(res, opt)
 	}
 	return res, nil
 }
 
+// A TCPOption is an option from a TCP header.
+//
+// The Data field does not include the kind and length
+// bytes.
 type TCPOption struct {
 	Kind byte
 	Data []byte
 }
 
+// NewTCPOptionMSS creates a maximum segment size option.
+func NewTCPOptionMSS(mss uint16) *TCPOption {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, mss)
+	return &TCPOption{Kind: TCPOptionMSS, Data: data}
+}
+
+// NewTCPOptionWindowScale creates a window scale option.
+func NewTCPOptionWindowScale(shift uint8) *TCPOption {
+	return &TCPOption{Kind: TCPOptionWindowScale, Data: []byte{shift}}
+}
+
+// NewTCPOptionSACKPermit creates an option indicating
+// that selective acknowledgements may be used.
+func NewTCPOptionSACKPermit() *TCPOption {
+	return &TCPOption{Kind: TCPOptionSACKPermit, Data: []byte{}}
+}
+
+// NewTCPOptionSACK creates a selective acknowledgement
+// option from a list of blocks.
+func NewTCPOptionSACK(blocks []TCPSACKBlock) *TCPOption {
+	data := make([]byte, 8*len(blocks))
+	for i, block := range blocks {
+		binary.BigEndian.PutUint32(data[i*8:], block.Start)
+		binary.BigEndian.PutUint32(data[i*8+4:], block.End)
+	}
+	return &TCPOption{Kind: TCPOptionSACK, Data: data}
+}
+
+// NewTCPOptionTimestamps creates a timestamps option
+// from a timestamp value and echo reply.
+func NewTCPOptionTimestamps(val, ecr uint32) *TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, val)
+	binary.BigEndian.PutUint32(data[4:], ecr)
+	return &TCPOption{Kind: TCPOptionTimestamps, Data: data}
+}
+
 func ReadTCPOption(r *bytes.Reader) (*TCPOption, error) {
 	kind, err := r.ReadByte()
 	if err != nil {
@@ -175,8 +232,11 @@ func ReadTCPOption(r *bytes.Reader) (*TCPOption, error) {
 	if err != nil {
 		return nil, io.ErrUnexpectedEOF
 	}
-	data := make([]byte, size)
-	if _, err := r.Read(data); err != nil {
+	if size < 2 {
+		return nil, errors.New("invalid option length")
+	}
+	data := make([]byte, size-2)
+	if _, err := io.ReadFull(r, data); err != nil {
 		return nil, io.ErrUnexpectedEOF
 	}
 	return &TCPOption{Kind: kind, Data: data}, nil
@@ -186,10 +246,71 @@ func (t *TCPOption) Encode() []byte {
 	if t.Kind < 2 {
 		return []byte{t.Kind}
 	} else {
-		return append([]byte{t.Kind, byte(len(t.Data))}, t.Data...)
+		return append([]byte{t.Kind, byte(len(t.Data) + 2)}, t.Data...)
 	}
 }
 
+// MSS decodes the value of a maximum segment size option.
+//
+// The second return value is false if the option is not
+// a valid MSS option.
+func (t *TCPOption) MSS() (uint16, bool) {
+	if t.Kind != TCPOptionMSS || len(t.Data) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(t.Data), true
+}
+
+// WindowScale decodes the shift from a window scale
+// option.
+//
+// The second return value is false if the option is not
+// a valid window scale option.
+func (t *TCPOption) WindowScale() (uint8, bool) {
+	if t.Kind != TCPOptionWindowScale || len(t.Data) != 1 {
+		return 0, false
+	}
+	return t.Data[0], true
+}
+
+// SACKBlocks decodes the blocks of a selective
+// acknowledgement option.
+//
+// The second return value is false if the option is not
+// a valid SACK option.
+func (t *TCPOption) SACKBlocks() ([]TCPSACKBlock, bool) {
+	if t.Kind != TCPOptionSACK || len(t.Data) == 0 || len(t.Data)%8 != 0 {
+		return nil, false
+	}
+	res := make([]TCPSACKBlock, len(t.Data)/8)
+	for i := range res {
+		res[i].Start = binary.BigEndian.Uint32(t.Data[i*8:])
+		res[i].End = binary.BigEndian.Uint32(t.Data[i*8+4:])
+	}
+	return res, true
+}
+
+// Timestamps decodes the timestamp value and echo reply
+// of a timestamps option.
+//
+// The last return value is false if the option is not a
+// valid timestamps option.
+func (t *TCPOption) Timestamps() (val, ecr uint32, ok bool) {
+	if t.Kind != TCPOptionTimestamps || len(t.Data) != 8 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(t.Data), binary.BigEndian.Uint32(t.Data[4:]), true
+}
+
+// A TCPSACKBlock is a range of sequence numbers that has
+// been selectively acknowledged.
+//
+// End is the first sequence number after the block.
+type TCPSACKBlock struct {
+	Start uint32
+	End   uint32
+}
+
 // A TCP4Packet is a TCP packet contained in an IPv4
 // packet.
 type TCP4Packet []byte
@@ -197,14 +318,32 @@ type TCP4Packet []byte
 // NewTCP4Packet constructs a generic TCP4Packet.
 func NewTCP4Packet(ttl int, source, dest *net.TCPAddr, seqNum, ackNum uint32, windowSize uint16,
 	payload []byte, flags ...Flag) TCP4Packet {
-	tcpPacket := append(make([]byte, 20), payload...)
-	header := TCPHeader(tcpPacket[:20])
+	return NewTCP4PacketOptions(ttl, source, dest, seqNum, ackNum, windowSize, nil, payload,
+		flags...)
+}
+
+// NewTCP4PacketOptions constructs a TCP4Packet with the
+// given options in its header.
+//
+// The options are padded to a multiple of four bytes.
+func NewTCP4PacketOptions(ttl int, source, dest *net.TCPAddr, seqNum, ackNum uint32,
+	windowSize uint16, options []*TCPOption, payload []byte, flags ...Flag) TCP4Packet {
+	var optionData []byte
+	for _, option := range options {
+		optionData = append(optionData, option.Encode()...)
+	}
+	for len(optionData)%4 != 0 {
+		optionData = append(optionData, TCPOptionEnd)
+	}
+	headerSize := 20 + len(optionData)
+	tcpPacket := append(append(make([]byte, 20), optionData...), payload...)
+	header := TCPHeader(tcpPacket[:headerSize])
 	header.SetSourcePort(uint16(source.Port))
 	header.SetDestPort(uint16(dest.Port))
 	header.SetSeqNum(seqNum)
 	header.SetAckNum(ackNum)
 	header.SetWindowSize(windowSize)
-	header.SetDataOffset(5)
+	header.SetDataOffset(uint8(headerSize / 4))
 	for _, flag := range flags {
 		header.SetFlag(flag, true)
 	}
@@ -293,4 +432,32 @@ type tcpSegment struct {
 	Start uint32
 	Data  []byte
 	Fin   bool
+
+	// If non-zero, Urgent is the urgent pointer, relative
+	// to Start. As described in RFC 6093, it points to
+	// the byte after the urgent data.
+	Urgent uint32
+
+	// Retransmit is set for outgoing segments which have
+	// been sent before.
+	Retransmit bool
+
+	// CWR is set for outgoing segments which signal that
+	// the congestion window was reduced due to ECN.
+	CWR bool
+}
+
+// End gets the sequence number after the segment.
+func (t *tcpSegment) End() uint32 {
+	end := t.Start + uint32(len(t.Data))
+	if t.Fin {
+		end++
+	}
+	return end
+}
+
+// tcpSeqLess checks if sequence number a comes before
+// sequence number b, using circular arithmetic.
+func tcpSeqLess(a, b uint32) bool {
+	return int32(a-b) < 0
 }
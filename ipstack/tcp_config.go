@@ -0,0 +1,162 @@
+package ipstack
+
+import "time"
+
+// DefaultTCPMSS is the default maximum segment size,
+// which fills a packet of DefaultMTU bytes.
+const DefaultTCPMSS = DefaultMTU - 40
+
+// DefaultTCPAckDelay is the default maximum time that an
+// ACK is delayed while waiting for outgoing data or
+// another segment to acknowledge.
+const DefaultTCPAckDelay = 40 * time.Millisecond
+
+// TCPConfig configures a TCPNet and its connections.
+//
+// Zero fields are replaced with defaults.
+type TCPConfig struct {
+	// TTL is the TTL field for all outgoing packets.
+	// If 0, DefaultTTL is used.
+	TTL int
+
+	// MSS is the maximum segment size advertised to
+	// remote hosts. It should be 40 bytes less than the
+	// largest packet the stream can carry without
+	// fragmentation.
+	// If 0, DefaultTCPMSS is used.
+	MSS int
+
+	// RecvBuffer is the number of bytes buffered for each
+	// connection's incoming data, and determines the
+	// largest receive window. Window scaling is used for
+	// buffers larger than 64KiB.
+	// If 0, DefaultTCPRecvBuffer is used.
+	RecvBuffer int
+
+	// SendBuffer is the number of bytes buffered for each
+	// connection's outgoing data. Writes block while the
+	// buffer is full of unacknowledged data.
+	// If 0, DefaultTCPSendBuffer is used.
+	SendBuffer int
+
+	// Backlog limits the number of connections each
+	// listener keeps while they are being established or
+	// waiting to be accepted. New connections are dropped
+	// while the backlog is full.
+	// If 0, DefaultTCPBacklog is used.
+	Backlog int
+
+	// If SYNCookies is true, listeners with a full backlog
+	// use SYN cookies rather than dropping new
+	// connections. Such connections do not support window
+	// scaling, selective acknowledgements, or timestamps.
+	SYNCookies bool
+
+	// HandshakeRetries is the number of times a SYN or
+	// SYN/ACK is sent before a handshake fails.
+	// If 0, DefaultTCPHandshakeRetries is used.
+	HandshakeRetries int
+
+	// Retransmits is the number of times that data is
+	// retransmitted after consecutive timeouts before a
+	// connection fails.
+	// If 0, DefaultTCPRetransmits is used.
+	Retransmits int
+
+	// InitialRTO is the retransmission timeout used before
+	// any round-trip time has been measured.
+	// If 0, DefaultTCPInitialRTO is used.
+	InitialRTO time.Duration
+
+	// MinRTO and MaxRTO bound the retransmission timeout.
+	// If 0, DefaultTCPMinRTO and DefaultTCPMaxRTO are
+	// used, respectively.
+	MinRTO time.Duration
+	MaxRTO time.Duration
+
+	// KeepAlive configures keepalive probes.
+	// The zero value disables keepalives.
+	KeepAlive TCPKeepAlive
+
+	// AckDelay is the longest time that an ACK for
+	// incoming data may be delayed.
+	// If 0, DefaultTCPAckDelay is used.
+	// If negative, ACKs are never delayed.
+	AckDelay time.Duration
+
+	// If NoDelay is true, Nagle's algorithm is disabled.
+	NoDelay bool
+
+	// If ECN is true, Explicit Congestion Notification is
+	// negotiated with remote hosts, as described in RFC
+	// 3168.
+	ECN bool
+
+	// If Timestamps is true, the timestamps option is
+	// negotiated with remote hosts, as described in RFC
+	// 7323. Timestamps improve round-trip time estimates,
+	// and protect fast connections from old segments once
+	// sequence numbers wrap around.
+	Timestamps bool
+
+	// CongestionControl creates the congestion controller
+	// for each connection.
+	// If nil, NewRenoController is used.
+	CongestionControl CongestionControl
+
+	// Clock is used for all timeouts and time
+	// measurements, including those made by congestion
+	// controllers such as CUBIC.
+	// If nil, SystemClock() is used.
+	Clock Clock
+}
+
+// newTCPConfig copies a configuration, replacing zero
+// fields with defaults.
+// If c is nil, all of the defaults are used.
+func newTCPConfig(c *TCPConfig) *TCPConfig {
+	var res TCPConfig
+	if c != nil {
+		res = *c
+	}
+	if res.TTL == 0 {
+		res.TTL = DefaultTTL
+	}
+	if res.MSS == 0 {
+		res.MSS = DefaultTCPMSS
+	}
+	if res.RecvBuffer == 0 {
+		res.RecvBuffer = DefaultTCPRecvBuffer
+	}
+	if res.SendBuffer == 0 {
+		res.SendBuffer = DefaultTCPSendBuffer
+	}
+	if res.Backlog == 0 {
+		res.Backlog = DefaultTCPBacklog
+	}
+	if res.HandshakeRetries == 0 {
+		res.HandshakeRetries = DefaultTCPHandshakeRetries
+	}
+	if res.Retransmits == 0 {
+		res.Retransmits = DefaultTCPRetransmits
+	}
+	if res.InitialRTO == 0 {
+		res.InitialRTO = DefaultTCPInitialRTO
+	}
+	if res.MinRTO == 0 {
+		res.MinRTO = DefaultTCPMinRTO
+	}
+	if res.MaxRTO == 0 {
+		res.MaxRTO = DefaultTCPMaxRTO
+	}
+	if res.AckDelay == 0 {
+		res.AckDelay = DefaultTCPAckDelay
+	}
+	if res.CongestionControl == nil {
+		res.CongestionControl = NewRenoController
+	}
+	if res.Clock == nil {
+		res.Clock = SystemClock()
+	}
+	return &res
+}
@@ -0,0 +1,250 @@
+package ipstack
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/unixpickle/essentials"
+)
+
+// A CongestionController limits the amount of data that a
+// TCP connection may have in the network.
+//
+// All sizes are measured in bytes.
+//
+// Implementations must be safe to use from multiple
+// Goroutines.
+type CongestionController interface {
+	// OnAck is called when an acknowledgement covers new
+	// data.
+	// The rtt argument is the current smoothed round-trip
+	// time, or 0 if it is unknown.
+	OnAck(acked int, rtt time.Duration)
+
+	// OnLoss is called when a loss is detected without a
+	// retransmission timeout, e.g. by duplicate acks, or
+	// when ECN signals congestion.
+	// The inFlight argument is the amount of data which
+	// was outstanding.
+	OnLoss(inFlight int)
+
+	// OnTimeout is called when the retransmission timer
+	// expires.
+	OnTimeout(inFlight int)
+
+	// CongestionWindow gets the congestion window.
+	CongestionWindow() int
+
+	// SlowStartThreshold gets the slow start threshold.
+	SlowStartThreshold() int
+}
+
+// A CongestionControl creates a CongestionController for
+// a connection with the given maximum segment size.
+//
+// NewRenoController and NewCUBICController may be used as
+// CongestionControls.
+type CongestionControl func(mss int) CongestionController
+
+// A clockSetter is a CongestionController which measures
+// time, and can use the Clock of its connection.
+type clockSetter interface {
+	setClock(clock Clock)
+}
+
+// newCongestionController creates a controller which
+// uses the given Clock, if it measures time.
+func newCongestionController(cc CongestionControl, mss int,
+	clock Clock) CongestionController {
+	res := cc(mss)
+	if setter, ok := res.(clockSetter); ok {
+		setter.setClock(clock)
+	}
+	return res
+}
+
+// tcpInitialWindow computes the initial congestion window
+// as described in RFC 6928.
+func tcpInitialWindow(mss int) int {
+	return essentials.MinInt(10*mss, essentials.MaxInt(2*mss, 14600))
+}
+
+type renoController struct {
+	lock     sync.Mutex
+	mss      int
+	cwnd     int
+	ssthresh int
+
+	// Bytes acknowledged during congestion avoidance
+	// since the window was last increased.
+	ackedBytes int
+}
+
+// NewRenoController creates a CongestionController which
+// implements the NewReno algorithm from RFC 5681.
+func NewRenoController(mss int) CongestionController {
+	return &renoController{
+		mss:      mss,
+		cwnd:     tcpInitialWindow(mss),
+		ssthresh: math.MaxInt32,
+	}
+}
+
+func (r *renoController) OnAck(acked int, rtt time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cwnd < r.ssthresh {
+		r.cwnd += essentials.MinInt(acked, r.mss)
+		return
+	}
+	r.ackedBytes += acked
+	if r.ackedBytes >= r.cwnd {
+		r.ackedBytes -= r.cwnd
+		r.cwnd += r.mss
+	}
+}
+
+func (r *renoController) OnLoss(inFlight int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ssthresh = essentials.MaxInt(inFlight/2, 2*r.mss)
+	r.cwnd = r.ssthresh
+	r.ackedBytes = 0
+}
+
+func (r *renoController) OnTimeout(inFlight int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ssthresh = essentials.MaxInt(inFlight/2, 2*r.mss)
+	r.cwnd = r.mss
+	r.ackedBytes = 0
+}
+
+func (r *renoController) CongestionWindow() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cwnd
+}
+
+func (r *renoController) SlowStartThreshold() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ssthresh
+}
+
+// Constants from RFC 9438.
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+type cubicController struct {
+	lock     sync.Mutex
+	clock    Clock
+	mss      int
+	cwnd     float64
+	ssthresh float64
+
+	// The window before the last reduction, in segments.
+	wMax     float64
+	lastWMax float64
+
+	// The start of the current congestion avoidance
+	// epoch, the time at which the window will reach
+	// wMax, and the Reno-friendly window estimate.
+	epochStart time.Time
+	k          float64
+	wEst       float64
+}
+
+// NewCUBICController creates a CongestionController which
+// implements the CUBIC algorithm from RFC 9438.
+func NewCUBICController(mss int) CongestionController {
+	return &cubicController{
+		clock:    SystemClock(),
+		mss:      mss,
+		cwnd:     float64(tcpInitialWindow(mss)),
+		ssthresh: math.MaxInt32,
+	}
+}
+
+func (c *cubicController) OnAck(acked int, rtt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	mss := float64(c.mss)
+	if c.cwnd < c.ssthresh {
+		c.cwnd += math.Min(float64(acked), mss)
+		return
+	}
+
+	cwnd := c.cwnd / mss
+	if c.epochStart.IsZero() {
+		c.epochStart = c.clock.Now()
+		if cwnd < c.wMax {
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+		} else {
+			c.k = 0
+			c.wMax = cwnd
+		}
+		c.wEst = cwnd
+	}
+
+	t := c.clock.Now().Sub(c.epochStart) + rtt
+	target := cubicC*math.Pow(t.Seconds()-c.k, 3) + c.wMax
+	target = math.Max(cwnd, math.Min(target, 1.5*cwnd))
+
+	// Grow at least as fast as Reno would.
+	alpha := 3 * (1 - cubicBeta) / (1 + cubicBeta)
+	c.wEst += alpha * float64(acked) / mss / cwnd
+	target = math.Max(target, c.wEst)
+
+	c.cwnd += (target - cwnd) / cwnd * float64(acked)
+}
+
+func (c *cubicController) setClock(clock Clock) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clock = clock
+}
+
+func (c *cubicController) OnLoss(inFlight int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reduce()
+	c.cwnd = c.ssthresh
+}
+
+func (c *cubicController) OnTimeout(inFlight int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.reduce()
+	c.cwnd = float64(c.mss)
+}
+
+func (c *cubicController) CongestionWindow() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return int(c.cwnd)
+}
+
+func (c *cubicController) SlowStartThreshold() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return int(c.ssthresh)
+}
+
+func (c *cubicController) reduce() {
+	cwnd := c.cwnd / float64(c.mss)
+	if cwnd < c.lastWMax {
+		// Fast convergence: release bandwidth for new
+		// flows.
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = cwnd
+	}
+	c.lastWMax = cwnd
+	c.ssthresh = math.Max(c.cwnd*cubicBeta, float64(2*c.mss))
+	c.epochStart = time.Time{}
+}
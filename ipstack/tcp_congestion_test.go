@@ -0,0 +1,89 @@
+package ipstack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenoController(t *testing.T) {
+	c := NewRenoController(1000)
+	if c.CongestionWindow() != 10000 {
+		t.Fatal("unexpected initial window", c.CongestionWindow())
+	}
+
+	// Slow start grows by one segment per ack.
+	c.OnAck(1000, 0)
+	c.OnAck(500, 0)
+	if c.CongestionWindow() != 11500 {
+		t.Fatal("unexpected slow start window", c.CongestionWindow())
+	}
+
+	c.OnLoss(9000)
+	if c.CongestionWindow() != 4500 || c.SlowStartThreshold() != 4500 {
+		t.Fatal("unexpected state after loss", c.CongestionWindow(), c.SlowStartThreshold())
+	}
+
+	// Congestion avoidance grows by one segment per window.
+	c.OnAck(4000, 0)
+	if c.CongestionWindow() != 4500 {
+		t.Fatal("grew too early", c.CongestionWindow())
+	}
+	c.OnAck(1000, 0)
+	if c.CongestionWindow() != 5500 {
+		t.Fatal("unexpected avoidance window", c.CongestionWindow())
+	}
+
+	c.OnTimeout(1000)
+	if c.CongestionWindow() != 1000 || c.SlowStartThreshold() != 2000 {
+		t.Fatal("unexpected state after timeout", c.CongestionWindow(), c.SlowStartThreshold())
+	}
+}
+
+func TestCUBICController(t *testing.T) {
+	c := NewCUBICController(1000)
+	for i := 0; i < 10; i++ {
+		c.OnAck(1000, 0)
+	}
+	if c.CongestionWindow() != 20000 {
+		t.Fatal("unexpected slow start window", c.CongestionWindow())
+	}
+
+	c.OnLoss(20000)
+	if c.CongestionWindow() != 14000 || c.SlowStartThreshold() != 14000 {
+		t.Fatal("unexpected state after loss", c.CongestionWindow(), c.SlowStartThreshold())
+	}
+
+	// The window grows, but only slowly right after a
+	// reduction.
+	for i := 0; i < 14; i++ {
+		c.OnAck(1000, 0)
+	}
+	if w := c.CongestionWindow(); w <= 14000 || w > 15000 {
+		t.Fatal("unexpected window after one round trip", w)
+	}
+
+	c.OnTimeout(20000)
+	if c.CongestionWindow() != 1000 {
+		t.Fatal("unexpected window after timeout", c.CongestionWindow())
+	}
+}
+
+func TestCUBICControllerClock(t *testing.T) {
+	// Growth in congestion avoidance depends only on the
+	// connection's clock.
+	windows := make([]int, 2)
+	for i, elapsed := range []time.Duration{0, 5 * time.Second} {
+		clock := NewManualClock(time.Unix(0, 0))
+		c := newCongestionController(NewCUBICController, 1000, clock)
+		c.OnLoss(20000)
+		c.OnAck(1000, 0)
+		clock.Advance(elapsed)
+		for j := 0; j < 14; j++ {
+			c.OnAck(1000, 0)
+		}
+		windows[i] = c.CongestionWindow()
+	}
+	if windows[1] <= windows[0] {
+		t.Fatal("window did not grow with time", windows)
+	}
+}
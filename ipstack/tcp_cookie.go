@@ -0,0 +1,97 @@
+package ipstack
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// tcpCookieMSS lists the maximum segment sizes which can
+// be encoded in a SYN cookie.
+var tcpCookieMSS = []uint16{536, 1300, 1440, 1460}
+
+// tcpCookiePeriod is how often the counter in SYN cookies
+// changes.
+// A cookie is valid for one to two periods.
+const tcpCookiePeriod = 64 * time.Second
+
+// A tcpCookieJar creates and validates SYN cookies, as
+// described in RFC 4987.
+//
+// A cookie is used as the initial sequence number of a
+// SYN/ACK. The top 5 bits are a counter, the next 3 bits
+// encode the MSS, and the rest is a keyed hash.
+type tcpCookieJar struct {
+	secret [32]byte
+	clock  Clock
+}
+
+func newTCPCookieJar(clock Clock) *tcpCookieJar {
+	res := &tcpCookieJar{clock: clock}
+	if _, err := rand.Read(res.secret[:]); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// Cookie creates a cookie for a SYN, given the MSS that
+// the peer advertised.
+//
+// The encoded MSS is never larger than mss. If mss is
+// smaller than every MSS that can be encoded, ok is
+// false and no cookie can be used.
+func (t *tcpCookieJar) Cookie(syn TCP4Packet, mss uint16) (cookie uint32, ok bool) {
+	mssIndex := -1
+	for i, x := range tcpCookieMSS {
+		if x <= mss {
+			mssIndex = i
+		}
+	}
+	if mssIndex < 0 {
+		return 0, false
+	}
+	counter := tcpCookieCounter(t.clock.Now())
+	hash := t.hash(syn.SourceAddr(), syn.DestAddr(), syn.Header().SeqNum(), counter)
+	return (counter%32)<<27 | uint32(mssIndex)<<24 | hash&0xffffff, true
+}
+
+// Check validates the ACK which completes a handshake.
+// If the cookie is valid, the encoded MSS is returned.
+func (t *tcpCookieJar) Check(ack TCP4Packet) (mss uint16, ok bool) {
+	cookie := ack.Header().AckNum() - 1
+	clientISN := ack.Header().SeqNum() - 1
+	now := tcpCookieCounter(t.clock.Now())
+	for _, counter := range []uint32{now, now - 1} {
+		if counter%32 != cookie>>27 {
+			continue
+		}
+		hash := t.hash(ack.SourceAddr(), ack.DestAddr(), clientISN, counter)
+		mssIndex := int(cookie>>24) & 7
+		if hash&0xffffff == cookie&0xffffff && mssIndex < len(tcpCookieMSS) {
+			return tcpCookieMSS[mssIndex], true
+		}
+	}
+	return 0, false
+}
+
+func (t *tcpCookieJar) hash(src, dst *net.TCPAddr, seq, counter uint32) uint32 {
+	h := hmac.New(sha256.New, t.secret[:])
+	h.Write(src.IP.To4())
+	h.Write(dst.IP.To4())
+	binary.Write(h, binary.BigEndian, []uint32{uint32(src.Port), uint32(dst.Port), seq,
+		counter})
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+// tcpIsCookieAck checks if a segment could complete a
+// handshake which used a SYN cookie.
+func tcpIsCookieAck(header TCPHeader) bool {
+	return header.Flag(ACK) && !header.Flag(SYN) && !header.Flag(RST)
+}
+
+func tcpCookieCounter(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(tcpCookiePeriod))
+}
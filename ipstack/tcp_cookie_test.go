@@ -0,0 +1,44 @@
+package ipstack
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTCPCookieJar(t *testing.T) {
+	jar := newTCPCookieJar(SystemClock())
+	client := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+	server := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 80}
+
+	syn := NewTCP4Packet(64, client, server, 1000, 0, 1024, nil, SYN)
+	cookie, ok := jar.Cookie(syn, 1450)
+	if !ok {
+		t.Fatal("no cookie")
+	}
+
+	ack := NewTCP4Packet(64, client, server, 1001, cookie+1, 1024, nil, ACK)
+	if mss, ok := jar.Check(ack); !ok || mss != 1440 {
+		t.Error("unexpected result", mss, ok)
+	}
+
+	ack = NewTCP4Packet(64, client, server, 1001, cookie+2, 1024, nil, ACK)
+	if _, ok := jar.Check(ack); ok {
+		t.Error("accepted bad cookie")
+	}
+	client.Port++
+	ack = NewTCP4Packet(64, client, server, 1001, cookie+1, 1024, nil, ACK)
+	if _, ok := jar.Check(ack); ok {
+		t.Error("accepted cookie from wrong address")
+	}
+
+	// An MSS below every table entry cannot be encoded.
+	if _, ok := jar.Cookie(syn, 300); ok {
+		t.Error("encoded an MSS larger than the negotiated one")
+	}
+	cookie, _ = jar.Cookie(syn, 536)
+	client.Port--
+	ack = NewTCP4Packet(64, client, server, 1001, cookie+1, 1024, nil, ACK)
+	if mss, ok := jar.Check(ack); !ok || mss != 536 {
+		t.Error("unexpected result", mss, ok)
+	}
+}
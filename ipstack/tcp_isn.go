@@ -0,0 +1,46 @@
+package ipstack
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// tcpISNTick is how often the clock component of an
+// initial sequence number increases, as suggested by
+// RFC 793.
+const tcpISNTick = 4 * time.Microsecond
+
+// A tcpISNGenerator picks initial sequence numbers as
+// described in RFC 6528.
+//
+// Each ISN is a timer which ticks every 4 microseconds,
+// plus a keyed hash of the connection's addresses.
+// Successive connections between the same endpoints get
+// increasing ISNs, while an attacker who cannot see the
+// traffic cannot guess the ISN of any connection.
+type tcpISNGenerator struct {
+	secret [32]byte
+}
+
+func newTCPISNGenerator() *tcpISNGenerator {
+	res := &tcpISNGenerator{}
+	if _, err := rand.Read(res.secret[:]); err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// ISN generates the initial sequence number for a new
+// connection at the given time.
+func (t *tcpISNGenerator) ISN(laddr, raddr *net.TCPAddr, now time.Time) uint32 {
+	h := hmac.New(sha256.New, t.secret[:])
+	h.Write(laddr.IP.To4())
+	h.Write(raddr.IP.To4())
+	binary.Write(h, binary.BigEndian, []uint32{uint32(laddr.Port), uint32(raddr.Port)})
+	counter := uint32(now.UnixNano() / int64(tcpISNTick))
+	return counter + binary.BigEndian.Uint32(h.Sum(nil))
+}
@@ -0,0 +1,30 @@
+package ipstack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPISNGenerator(t *testing.T) {
+	isns := newTCPISNGenerator()
+	client := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 5000}
+	server := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 80}
+	now := time.Unix(1000, 0)
+
+	isn := isns.ISN(server, client, now)
+	if isns.ISN(server, client, now) != isn {
+		t.Error("ISN is not deterministic")
+	}
+	if later := isns.ISN(server, client, now.Add(time.Millisecond)); later-isn != 250 {
+		t.Error("unexpected ISN increase", later-isn)
+	}
+
+	other := &net.TCPAddr{IP: client.IP, Port: client.Port + 1}
+	if isns.ISN(server, other, now) == isn {
+		t.Error("ISN does not depend on the address")
+	}
+	if newTCPISNGenerator().ISN(server, client, now) == isn {
+		t.Error("ISN does not depend on the secret")
+	}
+}
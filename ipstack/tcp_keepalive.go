@@ -0,0 +1,139 @@
+package ipstack
+
+import (
+	"sync"
+	"time"
+)
+
+// Default keepalive settings, matching common kernels.
+const (
+	DefaultTCPKeepAliveInterval = 75 * time.Second
+	DefaultTCPKeepAliveCount    = 9
+)
+
+var keepAliveTimeoutErr = &timeoutError{Context: "keepalive"}
+
+// TCPKeepAlive configures keepalive probes for idle TCP
+// connections.
+//
+// If a connection receives nothing for Idle, a probe is
+// sent every Interval. Once Count probes go unanswered,
+// the connection fails with a timeout error.
+type TCPKeepAlive struct {
+	// Idle is the idle time before the first probe.
+	// If 0, keepalives are disabled.
+	Idle time.Duration
+
+	// Interval is the time between probes.
+	// If 0, DefaultTCPKeepAliveInterval is used.
+	Interval time.Duration
+
+	// Count is the number of unanswered probes before the
+	// connection fails.
+	// If 0, DefaultTCPKeepAliveCount is used.
+	Count int
+}
+
+// A tcpKeepAliveTimer schedules keepalive probes for a
+// tcp4Conn.
+//
+// SetConfig may be called from any Goroutine. All other
+// methods should only be called by the connection's loop.
+type tcpKeepAliveTimer struct {
+	lock    sync.Mutex
+	config  TCPKeepAlive
+	changed chan struct{}
+
+	clock        Clock
+	timer        Timer
+	lastActivity time.Time
+	probes       int
+}
+
+func newTCPKeepAliveTimer(config TCPKeepAlive, clock Clock) *tcpKeepAliveTimer {
+	res := &tcpKeepAliveTimer{changed: make(chan struct{}, 1), clock: clock}
+	res.SetConfig(config)
+	return res
+}
+
+// SetConfig updates the configuration.
+// The loop is notified via Changed().
+func (t *tcpKeepAliveTimer) SetConfig(config TCPKeepAlive) {
+	if config.Interval == 0 {
+		config.Interval = DefaultTCPKeepAliveInterval
+	}
+	if config.Count == 0 {
+		config.Count = DefaultTCPKeepAliveCount
+	}
+	t.lock.Lock()
+	t.config = config
+	t.lock.Unlock()
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed gets a channel which is sent a value when the
+// configuration changes.
+func (t *tcpKeepAliveTimer) Changed() <-chan struct{} {
+	return t.changed
+}
+
+// Chan gets the channel for the current timer, or nil if
+// keepalives are disabled.
+func (t *tcpKeepAliveTimer) Chan() <-chan time.Time {
+	if t.timer == nil {
+		return nil
+	}
+	return t.timer.Chan()
+}
+
+// Activity records that a segment was received.
+func (t *tcpKeepAliveTimer) Activity() {
+	t.lastActivity = t.clock.Now()
+	t.probes = 0
+}
+
+// Restart restarts the idle period and the timer, e.g.
+// after the configuration changes.
+func (t *tcpKeepAliveTimer) Restart() {
+	t.Stop()
+	t.Activity()
+	if idle := t.getConfig().Idle; idle != 0 {
+		t.timer = t.clock.NewTimer(idle)
+	}
+}
+
+// Expire handles a timer expiration.
+// It returns true if a probe should be sent, or an error
+// if the connection should fail.
+func (t *tcpKeepAliveTimer) Expire() (bool, error) {
+	config := t.getConfig()
+	if t.probes == 0 {
+		if idle := t.clock.Now().Sub(t.lastActivity); idle < config.Idle {
+			t.timer.Reset(config.Idle - idle)
+			return false, nil
+		}
+	} else if t.probes >= config.Count {
+		t.Stop()
+		return false, keepAliveTimeoutErr
+	}
+	t.probes++
+	t.timer.Reset(config.Interval)
+	return true, nil
+}
+
+// Stop stops the timer.
+func (t *tcpKeepAliveTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
+
+func (t *tcpKeepAliveTimer) getConfig() TCPKeepAlive {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.config
+}
@@ -2,58 +2,160 @@ package ipstack
 
 import (
 	"errors"
-	"math/rand"
+	"net"
 	"time"
 )
 
-const tcpNumRetries = 10
+// DefaultTCPHandshakeRetries is the default number of
+// times a SYN is sent before a handshake fails. With
+// exponential backoff, this gives up after roughly a
+// minute.
+const DefaultTCPHandshakeRetries = 6
+
+// tcpDefaultMSS is the maximum segment size assumed for
+// a remote host that does not send an MSS option.
+const tcpDefaultMSS = 536
+
+// tcpMaxWindowScale is the largest window scale shift
+// allowed by RFC 7323.
+const tcpMaxWindowScale = 14
 
 type tcpHandshake struct {
 	localSeq  uint32
 	remoteSeq uint32
 
 	localWinSize  uint16
-	remoteWinSize uint16
+	remoteWinSize uint32
 
+	// The maximum segment size for outgoing segments.
+	// This is the smaller of the local and remote MSS.
 	mss uint16
+
+	// Shifts to apply to outgoing and incoming window
+	// fields, respectively.
+	localWinScale  uint8
+	remoteWinScale uint8
+
+	// If true, both ends support selective
+	// acknowledgements.
+	sack bool
+
+	// If true, both ends support ECN.
+	ecn bool
+
+	// If non-nil, both ends use the timestamps option.
+	timestamps *tcpTimestamps
+
+	// The round-trip time measured during the handshake,
+	// or 0 if the SYN had to be retransmitted.
+	rtt time.Duration
 }
 
 // tcp4ServerHandshake performs the handshake from the
-// server side.
-func tcp4ServerHandshake(stream Stream, syn TCP4Packet, ttl int) (*tcpHandshake, error) {
-	localSeq := rand.Uint32()
-	synAck := NewTCP4Packet(ttl, syn.DestAddr(), syn.SourceAddr(), localSeq,
-		syn.Header().SeqNum()+1, 1000, nil, SYN, ACK)
+// server side, using localSeq as the initial sequence
+// number.
+//
+// The config determines the TTL, the retransmission
+// timeouts, and the maximum segment size and window
+// which are advertised to the remote host. It must have
+// defaults filled in.
+//
+// A RST at the next sequence number aborts the handshake
+// with ConnectionResetErr, as RFC 9293 describes for the
+// SYN-RECEIVED state.
+func tcp4ServerHandshake(stream Stream, syn TCP4Packet, localSeq uint32,
+	config *TCPConfig) (*tcpHandshake, error) {
+	ttl, mss, recvBuf := config.TTL, uint16(config.MSS), config.RecvBuffer
+	remoteOpts := parseTCPSynOptions(syn.Header())
+	localOpts := newTCPSynOptions(mss, recvBuf)
+	if !remoteOpts.useWindowScale {
+		localOpts.useWindowScale = false
+		localOpts.windowScale = 0
+	}
+	localOpts.sackPermit = remoteOpts.sackPermit
+	var timestamps *tcpTimestamps
+	if config.Timestamps && remoteOpts.timestamps {
+		timestamps = newTCPTimestamps(config.Clock)
+		timestamps.SetRecent(remoteOpts.tsVal)
+		timestamps.lastAckSent = syn.Header().SeqNum() + 1
+		localOpts.timestamps = true
+		localOpts.tsVal = timestamps.Now()
+		localOpts.tsEcr = remoteOpts.tsVal
+	}
+	localWinSize := tcpSynWindow(recvBuf)
+	flags := []Flag{SYN, ACK}
+
+	// An ECN-setup SYN has both ECE and CWR set.
+	ecn := config.ECN && syn.Header().Flag(ECE) && syn.Header().Flag(CWR)
+	if ecn {
+		flags = append(flags, ECE)
+	}
+	remoteSeq := syn.Header().SeqNum() + 1
+	synAck := NewTCP4PacketOptions(ttl, syn.DestAddr(), syn.SourceAddr(), localSeq,
+		remoteSeq, localWinSize, localOpts.Encode(), nil, flags...)
+	challenges := newRateLimiter(tcpMaxChallengeAckRate, config.Clock)
+	start := config.Clock.Now()
+	var timer Timer
 OuterLoop:
-	for i := 0; i < tcpNumRetries; i++ {
-		select {
-		case <-stream.Done():
-			return nil, errors.New("stream closed")
-		default:
+	for i := 0; i < config.HandshakeRetries; i++ {
+		if err := Send(stream, synAck); err != nil {
+			return nil, err
 		}
-		select {
-		case stream.Outgoing() <- synAck:
-		default:
+		if timer == nil {
+			timer = config.Clock.NewTimer(tcpHandshakeTimeout(config, i))
+			defer timer.Stop()
+		} else {
+			timer.Reset(tcpHandshakeTimeout(config, i))
 		}
-		timeout := time.After(time.Second)
 		for {
 			select {
-			case <-timeout:
+			case <-timer.Chan():
 				continue OuterLoop
 			case packet := <-stream.Incoming():
 				if packet == nil {
 					return nil, errors.New("stream closed")
 				}
 				tp := TCP4Packet(packet)
+				if tp.Header().Flag(RST) {
+					// As for an established connection, only a
+					// RST at exactly the next sequence number is
+					// trusted (RFC 5961).
+					seq := tp.Header().SeqNum()
+					if seq == remoteSeq {
+						return nil, ConnectionResetErr
+					} else if !tcpSeqLess(seq, remoteSeq) &&
+						tcpSeqLess(seq, remoteSeq+uint32(localWinSize)) && challenges.Allow() {
+						var ackOpts []*TCPOption
+						if timestamps != nil {
+							ackOpts = []*TCPOption{{Kind: TCPOptionNop}, {Kind: TCPOptionNop},
+								timestamps.Option(remoteSeq)}
+						}
+						Send(stream, NewTCP4PacketOptions(ttl, syn.DestAddr(), syn.SourceAddr(),
+							localSeq+1, remoteSeq, localWinSize, ackOpts, nil, ACK))
+					}
+					continue
+				}
 				if tp.Header().Flag(ACK) && !tp.Header().Flag(SYN) &&
 					tp.Header().AckNum() == localSeq+1 {
+					// The window of the final ACK is scaled.
+					remoteWin := uint32(tp.Header().WindowSize()) << remoteOpts.windowScale
+					if timestamps != nil {
+						if val, _, ok := tcpTimestampsOption(tp.Header()); ok {
+							timestamps.Update(tp.Header().SeqNum(), val)
+						}
+					}
 					return &tcpHandshake{
-						localSeq:      localSeq + 1,
-						remoteSeq:     syn.Header().SeqNum() + 1,
-						localWinSize:  1000,
-						remoteWinSize: tp.Header().WindowSize(),
-						// TODO: read MSS from options.
-						mss: 512,
+						localSeq:       localSeq + 1,
+						remoteSeq:      remoteSeq,
+						localWinSize:   localWinSize,
+						remoteWinSize:  remoteWin,
+						mss:            tcpMinMSS(mss, remoteOpts.mss),
+						localWinScale:  localOpts.windowScale,
+						remoteWinScale: remoteOpts.windowScale,
+						sack:           remoteOpts.sackPermit,
+						ecn:            ecn,
+						timestamps:     timestamps,
+						rtt:            tcpHandshakeRTT(config.Clock, i, start),
 					}, nil
 				}
 			}
@@ -61,3 +163,214 @@ OuterLoop:
 	}
 	return nil, errors.New("connection failed")
 }
+
+// tcp4ClientHandshake performs the handshake from the
+// client side.
+//
+// The config is used in the same way as for
+// tcp4ServerHandshake.
+func tcp4ClientHandshake(stream Stream, laddr, raddr *net.TCPAddr, localSeq uint32,
+	config *TCPConfig) (*tcpHandshake, error) {
+	ttl, mss, recvBuf := config.TTL, uint16(config.MSS), config.RecvBuffer
+	localOpts := newTCPSynOptions(mss, recvBuf)
+	var timestamps *tcpTimestamps
+	if config.Timestamps {
+		timestamps = newTCPTimestamps(config.Clock)
+		localOpts.timestamps = true
+		localOpts.tsVal = timestamps.Now()
+	}
+	localWinSize := tcpSynWindow(recvBuf)
+	flags := []Flag{SYN}
+	if config.ECN {
+		flags = append(flags, ECE, CWR)
+	}
+	syn := NewTCP4PacketOptions(ttl, laddr, raddr, localSeq, 0, localWinSize,
+		localOpts.Encode(), nil, flags...)
+	start := config.Clock.Now()
+	var timer Timer
+OuterLoop:
+	for i := 0; i < config.HandshakeRetries; i++ {
+		if err := Send(stream, syn); err != nil {
+			return nil, err
+		}
+		if timer == nil {
+			timer = config.Clock.NewTimer(tcpHandshakeTimeout(config, i))
+			defer timer.Stop()
+		} else {
+			timer.Reset(tcpHandshakeTimeout(config, i))
+		}
+		for {
+			select {
+			case <-timer.Chan():
+				continue OuterLoop
+			case packet := <-stream.Incoming():
+				if packet == nil {
+					return nil, errors.New("stream closed")
+				}
+				header := TCP4Packet(packet).Header()
+				if !header.Flag(ACK) || header.AckNum() != localSeq+1 {
+					continue
+				}
+				if header.Flag(RST) {
+					return nil, ConnectionRefusedErr
+				}
+				if !header.Flag(SYN) {
+					continue
+				}
+				remoteOpts := parseTCPSynOptions(header)
+				if !remoteOpts.useWindowScale {
+					localOpts.windowScale = 0
+				}
+				remoteSeq := header.SeqNum() + 1
+				var ackOpts []*TCPOption
+				if !remoteOpts.timestamps {
+					timestamps = nil
+				} else if timestamps != nil {
+					timestamps.SetRecent(remoteOpts.tsVal)
+					ackOpts = []*TCPOption{{Kind: TCPOptionNop}, {Kind: TCPOptionNop},
+						timestamps.Option(remoteSeq)}
+				}
+				ack := NewTCP4PacketOptions(ttl, laddr, raddr, localSeq+1, remoteSeq,
+					tcpScaleWindow(uint32(recvBuf), localOpts.windowScale), ackOpts, nil, ACK)
+				if err := Send(stream, ack); err != nil {
+					return nil, err
+				}
+				return &tcpHandshake{
+					localSeq:     localSeq + 1,
+					remoteSeq:    remoteSeq,
+					localWinSize: localWinSize,
+					// The window of a SYN is never scaled.
+					remoteWinSize:  uint32(header.WindowSize()),
+					mss:            tcpMinMSS(mss, remoteOpts.mss),
+					localWinScale:  localOpts.windowScale,
+					remoteWinScale: remoteOpts.windowScale,
+					sack:           remoteOpts.sackPermit,
+					ecn:            config.ECN && header.Flag(ECE) && !header.Flag(CWR),
+					timestamps:     timestamps,
+					rtt:            tcpHandshakeRTT(config.Clock, i, start),
+				}, nil
+			}
+		}
+	}
+	return nil, errors.New("connection failed")
+}
+
+// tcpHandshakeTimeout gets the retransmission timeout for
+// the given attempt of a handshake.
+func tcpHandshakeTimeout(config *TCPConfig, attempt int) time.Duration {
+	timeout := config.InitialRTO << uint(attempt)
+	if timeout > config.MaxRTO || timeout <= 0 {
+		return config.MaxRTO
+	}
+	return timeout
+}
+
+// tcpHandshakeRTT computes the round-trip time of a
+// handshake, following Karn's algorithm.
+func tcpHandshakeRTT(clock Clock, attempt int, start time.Time) time.Duration {
+	if attempt > 0 {
+		return 0
+	}
+	return clock.Now().Sub(start)
+}
+
+// tcpSynOptions stores the options which are negotiated
+// in SYN packets.
+type tcpSynOptions struct {
+	mss uint16
+
+	useWindowScale bool
+	windowScale    uint8
+
+	sackPermit bool
+
+	// The timestamp value and echo reply, if the
+	// timestamps option is used.
+	timestamps bool
+	tsVal      uint32
+	tsEcr      uint32
+}
+
+// newTCPSynOptions creates the local options for a host
+// with the given MSS and receive buffer size.
+func newTCPSynOptions(mss uint16, recvBuf int) *tcpSynOptions {
+	var scale uint8
+	for scale < tcpMaxWindowScale && recvBuf>>scale > 0xffff {
+		scale++
+	}
+	return &tcpSynOptions{
+		mss:            mss,
+		useWindowScale: true,
+		windowScale:    scale,
+		sackPermit:     true,
+	}
+}
+
+// parseTCPSynOptions reads the options from a SYN header.
+// Missing or invalid options are replaced with defaults.
+func parseTCPSynOptions(header TCPHeader) *tcpSynOptions {
+	res := &tcpSynOptions{mss: tcpDefaultMSS}
+	options, err := header.TCPOptions()
+	if err != nil {
+		return res
+	}
+	for _, option := range options {
+		if mss, ok := option.MSS(); ok && mss > 0 {
+			res.mss = mss
+		} else if scale, ok := option.WindowScale(); ok {
+			res.useWindowScale = true
+			res.windowScale = scale
+			if scale > tcpMaxWindowScale {
+				res.windowScale = tcpMaxWindowScale
+			}
+		} else if option.Kind == TCPOptionSACKPermit {
+			res.sackPermit = true
+		} else if val, ecr, ok := option.Timestamps(); ok {
+			res.timestamps = true
+			res.tsVal = val
+			res.tsEcr = ecr
+		}
+	}
+	return res
+}
+
+// Encode creates the TCP options for a SYN packet.
+func (t *tcpSynOptions) Encode() []*TCPOption {
+	res := []*TCPOption{NewTCPOptionMSS(t.mss)}
+	if t.useWindowScale {
+		res = append(res, &TCPOption{Kind: TCPOptionNop},
+			NewTCPOptionWindowScale(t.windowScale))
+	}
+	if t.sackPermit {
+		res = append(res, &TCPOption{Kind: TCPOptionNop}, &TCPOption{Kind: TCPOptionNop},
+			NewTCPOptionSACKPermit())
+	}
+	if t.timestamps {
+		res = append(res, &TCPOption{Kind: TCPOptionNop}, &TCPOption{Kind: TCPOptionNop},
+			NewTCPOptionTimestamps(t.tsVal, t.tsEcr))
+	}
+	return res
+}
+
+// tcpSynWindow computes the (unscaled) window field for
+// a SYN packet.
+func tcpSynWindow(recvBuf int) uint16 {
+	return tcpScaleWindow(uint32(recvBuf), 0)
+}
+
+// tcpScaleWindow computes the window field for a window
+// size and a window scale shift.
+func tcpScaleWindow(window uint32, scale uint8) uint16 {
+	window >>= scale
+	if window > 0xffff {
+		return 0xffff
+	}
+	return uint16(window)
+}
+
+func tcpMinMSS(local, remote uint16) uint16 {
+	if remote < local {
+		return remote
+	}
+	return local
+}
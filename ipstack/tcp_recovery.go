@@ -0,0 +1,116 @@
+package ipstack
+
+// tcpDupThresh is the number of duplicate acks which
+// trigger a fast retransmit.
+const tcpDupThresh = 3
+
+// TCPRecoveryStats counts how a TCP connection has
+// recovered from lost segments.
+type TCPRecoveryStats struct {
+	// Retransmits is the number of segments which have
+	// been retransmitted for any reason.
+	Retransmits int
+
+	// FastRetransmits is the number of times that
+	// duplicate acks triggered a fast retransmit.
+	FastRetransmits int
+
+	// Timeouts is the number of times that the
+	// retransmission timer expired with data in flight.
+	Timeouts int
+}
+
+// handleDupAck processes a duplicate ack, possibly
+// entering fast recovery as described in RFC 6582.
+func (s *simpleTcpSend) handleDupAck(ack uint32) {
+	s.dupAcks++
+	if s.recovering {
+		// Each duplicate ack indicates that another segment
+		// has left the network.
+		s.inflation += int(s.maxSegmentSize)
+		s.markSACKLost()
+		return
+	}
+	if s.dupAcks != tcpDupThresh || !tcpSeqLess(s.recover, ack) {
+		return
+	}
+	s.congestion.OnLoss(int(s.sentSeq - s.writeBuf.sequence))
+	s.recovering = true
+	s.recover = s.sentSeq
+	s.inflation = tcpDupThresh * int(s.maxSegmentSize)
+	s.highRxt = s.writeBuf.sequence
+	s.stats.FastRetransmits++
+	s.retransmitFirst()
+	s.markSACKLost()
+}
+
+// handleRecoveryAck processes an ack for new data during
+// fast recovery.
+// The acked argument is the number of bytes acked.
+func (s *simpleTcpSend) handleRecoveryAck(ack uint32, acked int) {
+	if !tcpSeqLess(ack, s.recover) {
+		s.exitRecovery()
+		return
+	}
+
+	// A partial ack means that the next segment was lost
+	// as well.
+	s.inflation -= acked - int(s.maxSegmentSize)
+	if s.inflation < 0 {
+		s.inflation = 0
+	}
+	s.retransmitFirst()
+	s.markSACKLost()
+}
+
+// exitRecovery leaves fast recovery, if the sender is in
+// it.
+func (s *simpleTcpSend) exitRecovery() {
+	s.recovering = false
+	s.inflation = 0
+	s.dupAcks = 0
+}
+
+// retransmitFirst retransmits the first unacknowledged
+// segment as soon as possible, regardless of the
+// congestion window.
+//
+// Segments which SACK already marked as lost during this
+// recovery are not retransmitted again.
+func (s *simpleTcpSend) retransmitFirst() {
+	if len(s.inFlight) > 0 && !tcpSeqLess(s.inFlight[0].Start, s.highRxt) {
+		s.inFlight[0].Lost = true
+		s.retransmitNow = true
+	}
+}
+
+// markSACKLost marks every segment below the highest
+// selectively acknowledged data as lost, unless it was
+// selectively acknowledged itself or already marked
+// during this recovery.
+//
+// This is a simpler form of IsLost() from RFC 6675, and
+// lets every hole in the window be repaired at once
+// rather than one per round trip. Lost segments do not
+// count towards the pipe, so they are retransmitted as
+// the congestion window allows.
+func (s *simpleTcpSend) markSACKLost() {
+	highest, ok := s.writeBuf.HighestSACK()
+	if !ok {
+		return
+	}
+	una := s.writeBuf.sequence
+	for _, seg := range s.inFlight {
+		if tcpSeqLess(highest, seg.End) {
+			break
+		}
+		if !tcpSeqLess(s.highRxt, seg.End) {
+			continue
+		}
+		s.highRxt = seg.End
+		start, end := int(seg.Start-una), int(seg.End-una)
+		if s.writeBuf.sacked.Count(start, end) < end-start {
+			seg.Lost = true
+		}
+	}
+}
@@ -19,10 +19,20 @@ type tcpRecv interface {
 	// SetDeadline updates the deadline for all reads.
 	SetDeadline(t time.Time)
 
+	// CloseRead causes all subsequent reads to return EOF.
+	// Buffered and incoming data is discarded.
+	CloseRead()
+
 	// Handle notifies the receiver of incoming data.
 	// This may cause reads to unblock.
 	Handle(segment *tcpSegment)
 
+	// UrgentOffset gets the number of bytes which must be
+	// read to reach the end of the most recent urgent
+	// data, if urgent data has not been read yet.
+	// Reads never continue past the end of urgent data.
+	UrgentOffset() (n int, ok bool)
+
 	// Fail notifies the receiver of some kind of
 	// connection error.
 	// Errors are processed after all buffered data has
@@ -33,8 +43,14 @@ type tcpRecv interface {
 	// Ack gets the first unacknowledged sequence number.
 	Ack() uint32
 
+	// SACKBlocks gets up to maxBlocks SACK blocks which
+	// describe out-of-order data that has been received.
+	SACKBlocks(maxBlocks int) []TCPSACKBlock
+
 	// Window gets the current window size.
-	Window() uint16
+	// This is not limited to 16 bits, since it may be
+	// scaled down before being sent.
+	Window() uint32
 
 	// WindowOpen is a channel which is sent a value when
 	// the window size goes from zero to non-zero.
@@ -54,15 +70,21 @@ type simpleTcpRecv struct {
 	notify     chan struct{}
 	windowOpen chan struct{}
 	deadline   *deadlineManager
+	readClosed bool
+
+	// If hasUrgent is set, urgentEnd is the sequence
+	// number after the last urgent byte.
+	hasUrgent bool
+	urgentEnd uint32
 }
 
-func newSimpleTcpRecv(startSeq uint32, bufSize int) *simpleTcpRecv {
+func newSimpleTcpRecv(startSeq uint32, bufSize int, clock Clock) *simpleTcpRecv {
 	return &simpleTcpRecv{
-		assembler:  newTCPAssembler(startSeq),
+		assembler:  newTCPAssembler(startSeq, bufSize),
 		buffer:     newTCPRecvBuffer(bufSize),
 		notify:     make(chan struct{}),
 		windowOpen: make(chan struct{}, 1),
-		deadline:   newDeadlineManager(),
+		deadline:   newDeadlineManager(clock),
 	}
 }
 
@@ -75,6 +97,15 @@ func (s *simpleTcpRecv) Read(b []byte) (int, error) {
 
 	s.lock.Lock()
 
+	if s.readClosed {
+		s.lock.Unlock()
+		return 0, io.EOF
+	}
+
+	if n, ok := s.urgentOffset(); ok && n < len(b) {
+		b = b[:n]
+	}
+
 	oldWindow := s.buffer.Window()
 	numBytes, eof := s.buffer.Get(b)
 	if s.buffer.Window() != 0 && oldWindow == 0 {
@@ -115,11 +146,39 @@ func (s *simpleTcpRecv) SetDeadline(t time.Time) {
 	s.deadline.SetDeadline(t)
 }
 
+func (s *simpleTcpRecv) CloseRead() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.readClosed {
+		return
+	}
+	s.readClosed = true
+	oldWindow := s.buffer.Window()
+	s.buffer.Discard()
+	if oldWindow == 0 {
+		select {
+		case s.windowOpen <- struct{}{}:
+		default:
+		}
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
 func (s *simpleTcpRecv) Handle(segment *tcpSegment) {
 	s.lock.Lock()
+	if segment.Urgent != 0 && !s.readClosed {
+		end := segment.Start + segment.Urgent
+		if !s.hasUrgent || tcpSeqLess(s.urgentEnd, end) {
+			s.hasUrgent = true
+			s.urgentEnd = end
+		}
+	}
 	s.assembler.AddSegment(segment)
 	newData, eof := s.assembler.Skim(s.buffer.Window())
-	s.buffer.Put(newData)
+	if !s.readClosed {
+		s.buffer.Put(newData)
+	}
 	if eof {
 		s.buffer.PutEOF()
 	}
@@ -128,6 +187,28 @@ func (s *simpleTcpRecv) Handle(segment *tcpSegment) {
 	s.lock.Unlock()
 }
 
+func (s *simpleTcpRecv) UrgentOffset() (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.urgentOffset()
+}
+
+func (s *simpleTcpRecv) urgentOffset() (int, bool) {
+	if !s.hasUrgent {
+		return 0, false
+	}
+	readSeq := s.assembler.Seq() - uint32(s.buffer.size)
+	if s.buffer.hitEOF {
+		// The FIN is included in the sequence number.
+		readSeq--
+	}
+	if !tcpSeqLess(readSeq, s.urgentEnd) {
+		s.hasUrgent = false
+		return 0, false
+	}
+	return int(s.urgentEnd - readSeq), true
+}
+
 func (s *simpleTcpRecv) Fail(err error) {
 	s.lock.Lock()
 	s.failErr = err
@@ -142,10 +223,16 @@ func (s *simpleTcpRecv) Ack() uint32 {
 	return s.assembler.Seq()
 }
 
-func (s *simpleTcpRecv) Window() uint16 {
+func (s *simpleTcpRecv) SACKBlocks(maxBlocks int) []TCPSACKBlock {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.assembler.SACKBlocks(maxBlocks)
+}
+
+func (s *simpleTcpRecv) Window() uint32 {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	return uint16(s.buffer.Window())
+	return uint32(s.buffer.Window())
 }
 
 func (s *simpleTcpRecv) WindowOpen() <-chan struct{} {
@@ -164,12 +251,17 @@ type tcpAssembler struct {
 	// The sequence number of the start of the buffer.
 	sequence uint32
 
-	// Data in the pipeline.
+	// Data in the pipeline, stored as a ring buffer which
+	// begins at index start.
 	buffer []byte
+	start  int
+
+	// The ranges of buffer which have been received.
+	received tcpRangeSet
 
-	// A boolean for each byte of buffer indicating if
-	// that byte has been received.
-	mask []bool
+	// The range containing the most recently received
+	// out-of-order segment, used to order SACK blocks.
+	recent tcpRange
 
 	// If greater than -2, indicates the position in the
 	// buffer that represents EOF. This should come after
@@ -178,11 +270,10 @@ type tcpAssembler struct {
 	fin int
 }
 
-func newTCPAssembler(seq uint32) *tcpAssembler {
+func newTCPAssembler(seq uint32, bufSize int) *tcpAssembler {
 	return &tcpAssembler{
 		sequence: seq,
-		buffer:   make([]byte, 65536),
-		mask:     make([]bool, 65536),
+		buffer:   make([]byte, bufSize),
 		fin:      -2,
 	}
 }
@@ -192,14 +283,31 @@ func (t *tcpAssembler) AddSegment(s *tcpSegment) {
 	if t.fin == 0 || t.fin == -1 {
 		return
 	}
-	for i, b := range s.Data {
-		offset := uint32(i) + s.Start - t.sequence
-		if offset >= uint32(len(t.buffer)) {
-			continue
+
+	// Trim data that lies outside of the buffer.
+	data := s.Data
+	offset := int(int32(s.Start - t.sequence))
+	if offset < 0 {
+		if -offset >= len(data) {
+			data = nil
+		} else {
+			data = data[-offset:]
+		}
+		offset = 0
+	}
+	if offset < len(t.buffer) && len(data) > 0 {
+		if offset+len(data) > len(t.buffer) {
+			data = data[:len(t.buffer)-offset]
+		}
+		idx := t.index(offset)
+		n := copy(t.buffer[idx:], data)
+		copy(t.buffer, data[n:])
+		merged := t.received.Add(offset, offset+len(data))
+		if offset > 0 {
+			t.recent = merged
 		}
-		t.buffer[offset] = b
-		t.mask[offset] = true
 	}
+
 	if s.Fin {
 		finOffset := s.Start + uint32(len(s.Data)) - t.sequence
 		if finOffset <= uint32(len(t.buffer)) {
@@ -214,26 +322,33 @@ func (t *tcpAssembler) Skim(maxBytes int) (avail []byte, eof bool) {
 	if t.fin == -1 {
 		return nil, true
 	}
-	for i, f := range t.mask {
-		if i == t.fin {
-			eof = true
-			break
-		}
-		if i == maxBytes || !f {
-			break
-		}
-		avail = append(avail, t.buffer[i])
+	var size int
+	if len(t.received) > 0 && t.received[0].Start == 0 {
+		size = t.received[0].End
 	}
-	readSize := len(avail)
+	if size > maxBytes {
+		size = maxBytes
+	}
+	if t.fin >= 0 && size >= t.fin {
+		size = t.fin
+		eof = true
+	}
+
+	avail = make([]byte, size)
+	n := copy(avail, t.buffer[t.start:])
+	copy(avail[n:], t.buffer)
+
+	readSize := size
 	if eof {
 		readSize += 1
 	}
+	t.start = t.index(size)
 	t.sequence += uint32(readSize)
-	t.fin -= readSize
-	copy(t.buffer, t.buffer[readSize:])
-	copy(t.mask, t.mask[readSize:])
-	for i := len(t.mask) - readSize; i < len(t.mask); i++ {
-		t.mask[i] = false
+	t.received.Shift(readSize)
+	t.recent.Start -= readSize
+	t.recent.End -= readSize
+	if t.fin >= 0 {
+		t.fin -= readSize
 	}
 	return
 }
@@ -243,14 +358,50 @@ func (t *tcpAssembler) Seq() uint32 {
 	return t.sequence
 }
 
+// SACKBlocks generates selective acknowledgement blocks
+// for the out-of-order data in the buffer.
+//
+// The block containing the most recently received
+// segment comes first, as required by RFC 2018.
+// At most maxBlocks blocks are returned.
+func (t *tcpAssembler) SACKBlocks(maxBlocks int) []TCPSACKBlock {
+	var res []TCPSACKBlock
+	addBlock := func(r tcpRange) {
+		if len(res) < maxBlocks {
+			res = append(res, TCPSACKBlock{
+				Start: t.sequence + uint32(r.Start),
+				End:   t.sequence + uint32(r.End),
+			})
+		}
+	}
+	recent, hasRecent := t.received.Find(t.recent.Start)
+	if hasRecent && recent.Start > 0 {
+		addBlock(recent)
+	}
+	for _, r := range t.received {
+		if r.Start > 0 && (!hasRecent || r != recent) {
+			addBlock(r)
+		}
+	}
+	return res
+}
+
+// index converts an offset from the start of the buffer
+// into an index in the ring buffer.
+func (t *tcpAssembler) index(offset int) int {
+	return (t.start + offset) % len(t.buffer)
+}
+
 // A tcpRecvBuffer performs flow control for incoming TCP
 // data.
 type tcpRecvBuffer struct {
 	// The number of readable bytes in the buffer.
 	size int
 
-	// The buffer of available bytes.
+	// The ring buffer of available bytes, starting at
+	// index start.
 	buffer []byte
+	start  int
 
 	// A flag which is set to true if EOF should be
 	// produced once the buffer is drained.
@@ -270,7 +421,9 @@ func (t *tcpRecvBuffer) Put(data []byte) {
 	if len(data) > t.Window() {
 		panic("buffer overflow")
 	}
-	copy(t.buffer[t.size:], data)
+	end := (t.start + t.size) % len(t.buffer)
+	n := copy(t.buffer[end:], data)
+	copy(t.buffer, data[n:])
 	t.size += len(data)
 }
 
@@ -287,12 +440,19 @@ func (t *tcpRecvBuffer) Get(b []byte) (int, bool) {
 	if canRead > len(b) {
 		canRead = len(b)
 	}
-	copy(b, t.buffer[:canRead])
-	copy(t.buffer, t.buffer[canRead:])
+	n := copy(b[:canRead], t.buffer[t.start:])
+	copy(b[n:canRead], t.buffer)
+	t.start = (t.start + canRead) % len(t.buffer)
 	t.size -= canRead
 	return canRead, t.size == 0 && t.hitEOF
 }
 
+// Discard removes all data from the buffer.
+func (t *tcpRecvBuffer) Discard() {
+	t.start = 0
+	t.size = 0
+}
+
 // Window gets the number of unused bytes in the buffer.
 func (t *tcpRecvBuffer) Window() int {
 	return len(t.buffer) - t.size
@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"reflect"
 	"testing"
 )
 
 func TestTCPAssembler(t *testing.T) {
-	a := newTCPAssembler(0xfffffffe)
+	a := newTCPAssembler(0xfffffffe, 65536)
 	a.AddSegment(&tcpSegment{
 		Start: 10,
 		Data:  []byte("hi!"),
@@ -53,9 +54,74 @@ func TestTCPAssembler(t *testing.T) {
 	}
 }
 
+func TestTCPAssemblerWrap(t *testing.T) {
+	a := newTCPAssembler(100, 8)
+	a.AddSegment(&tcpSegment{Start: 100, Data: []byte("abcdef")})
+	if res, _ := a.Skim(8); !bytes.Equal(res, []byte("abcdef")) {
+		t.Fatal("unexpected bytes", string(res))
+	}
+	a.AddSegment(&tcpSegment{Start: 110, Data: []byte("klmnopq"), Fin: true})
+	if res, eof := a.Skim(8); len(res) != 0 || eof {
+		t.Fatal("unexpected result")
+	}
+	a.AddSegment(&tcpSegment{Start: 104, Data: []byte("efghi")})
+	if res, eof := a.Skim(8); !bytes.Equal(res, []byte("ghi")) || eof {
+		t.Fatal("unexpected result", string(res), eof)
+	}
+	a.AddSegment(&tcpSegment{Start: 109, Data: []byte("jklmnopq"), Fin: true})
+	if res, eof := a.Skim(8); !bytes.Equal(res, []byte("jklmnopq")) || !eof {
+		t.Fatal("unexpected result", string(res), eof)
+	}
+	if a.Seq() != 118 {
+		t.Fatal("unexpected sequence number", a.Seq())
+	}
+}
+
+func TestTCPAssemblerSACK(t *testing.T) {
+	a := newTCPAssembler(1000, 100)
+	a.AddSegment(&tcpSegment{Start: 1010, Data: []byte("abc")})
+	a.AddSegment(&tcpSegment{Start: 1030, Data: []byte("abc")})
+	a.AddSegment(&tcpSegment{Start: 1020, Data: []byte("abc")})
+	a.AddSegment(&tcpSegment{Start: 1013, Data: []byte("abc")})
+	expected := []TCPSACKBlock{{1010, 1016}, {1020, 1023}, {1030, 1033}}
+	if blocks := a.SACKBlocks(4); !reflect.DeepEqual(blocks, expected) {
+		t.Fatal("unexpected blocks", blocks)
+	}
+	a.AddSegment(&tcpSegment{Start: 1033, Data: []byte("abc")})
+	expected = []TCPSACKBlock{{1030, 1036}, {1010, 1016}}
+	if blocks := a.SACKBlocks(2); !reflect.DeepEqual(blocks, expected) {
+		t.Fatal("unexpected blocks", blocks)
+	}
+	a.AddSegment(&tcpSegment{Start: 1000, Data: []byte("0123456789")})
+	if res, _ := a.Skim(100); len(res) != 16 {
+		t.Fatal("unexpected skim size", len(res))
+	}
+	expected = []TCPSACKBlock{{1030, 1036}, {1020, 1023}}
+	if blocks := a.SACKBlocks(4); !reflect.DeepEqual(blocks, expected) {
+		t.Fatal("unexpected blocks", blocks)
+	}
+}
+
+func TestTCPRecvBufferWrap(t *testing.T) {
+	b := newTCPRecvBuffer(8)
+	out := make([]byte, 8)
+	b.Put([]byte("abcde"))
+	if n, _ := b.Get(out[:3]); n != 3 || !bytes.Equal(out[:3], []byte("abc")) {
+		t.Fatal("unexpected result")
+	}
+	b.Put([]byte("fghijk"))
+	if b.Window() != 0 {
+		t.Fatal("unexpected window", b.Window())
+	}
+	b.PutEOF()
+	if n, eof := b.Get(out); n != 8 || !eof || !bytes.Equal(out, []byte("defghijk")) {
+		t.Fatal("unexpected result", n, eof, string(out))
+	}
+}
+
 func TestTCPRecvFail(t *testing.T) {
 	done := make(chan struct{})
-	recv := newSimpleTcpRecv(1337, 1000)
+	recv := newSimpleTcpRecv(1337, 1000, SystemClock())
 	go func() {
 		data := make([]byte, 100)
 		_, err := recv.Read(data)
@@ -70,7 +136,7 @@ func TestTCPRecvFail(t *testing.T) {
 
 func TestTCPRecvSuccess(t *testing.T) {
 	done := make(chan struct{})
-	recv := newSimpleTcpRecv(1337, 1000)
+	recv := newSimpleTcpRecv(1337, 1000, SystemClock())
 	go func() {
 		data := make([]byte, 100)
 		n, err := recv.Read(data)
@@ -99,3 +165,28 @@ func TestTCPRecvSuccess(t *testing.T) {
 	}
 	<-done
 }
+
+func TestTCPRecvUrgent(t *testing.T) {
+	recv := newSimpleTcpRecv(1000, 1000, SystemClock())
+	recv.Handle(&tcpSegment{Start: 1000, Data: []byte("abc")})
+	if _, ok := recv.UrgentOffset(); ok {
+		t.Fatal("unexpected urgent data")
+	}
+	recv.Handle(&tcpSegment{Start: 1003, Data: []byte("defgh"), Urgent: 3})
+	if n, ok := recv.UrgentOffset(); !ok || n != 6 {
+		t.Fatal("unexpected urgent offset", n, ok)
+	}
+
+	data := make([]byte, 100)
+	n, err := recv.Read(data)
+	if err != nil || string(data[:n]) != "abcdef" {
+		t.Fatal("unexpected read", string(data[:n]), err)
+	}
+	if _, ok := recv.UrgentOffset(); ok {
+		t.Fatal("unexpected urgent data")
+	}
+	n, err = recv.Read(data)
+	if err != nil || string(data[:n]) != "gh" {
+		t.Fatal("unexpected read", string(data[:n]), err)
+	}
+}
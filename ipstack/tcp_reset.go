@@ -0,0 +1,94 @@
+package ipstack
+
+import (
+	"sync"
+	"time"
+)
+
+// tcpMaxResetRate is the maximum number of RST segments
+// that a TCPNet sends per second in response to segments
+// for unknown connections.
+// Limiting this prevents the network from being used as
+// a reflector.
+const tcpMaxResetRate = 100
+
+// A tcpResetter answers segments for unknown connections
+// with RSTs, at a limited rate.
+type tcpResetter struct {
+	ttl     int
+	limiter *rateLimiter
+}
+
+func newTCPResetter(ttl int, clock Clock) *tcpResetter {
+	return &tcpResetter{ttl: ttl, limiter: newRateLimiter(tcpMaxResetRate, clock)}
+}
+
+// Reject answers a segment which matched no connection
+// or listener.
+func (t *tcpResetter) Reject(stream Stream, packet TCP4Packet) {
+	if reset := tcp4Reset(t.ttl, packet); reset != nil && t.limiter.Allow() {
+		Send(stream, reset)
+	}
+}
+
+// tcp4Reset creates a RST in response to a segment, as
+// described in RFC 9293.
+//
+// It returns nil if no RST should be sent.
+func tcp4Reset(ttl int, packet TCP4Packet) TCP4Packet {
+	header := packet.Header()
+	if header.Flag(RST) {
+		return nil
+	}
+	laddr, raddr := packet.DestAddr(), packet.SourceAddr()
+	if header.Flag(ACK) {
+		return NewTCP4Packet(ttl, laddr, raddr, header.AckNum(), 0, 0, nil, RST)
+	}
+	ack := header.SeqNum() + uint32(len(packet.Payload()))
+	if header.Flag(SYN) {
+		ack++
+	}
+	if header.Flag(FIN) {
+		ack++
+	}
+	return NewTCP4Packet(ttl, laddr, raddr, 0, ack, 0, nil, RST, ACK)
+}
+
+// A rateLimiter is a token bucket which allows events up
+// to a fixed rate.
+type rateLimiter struct {
+	lock   sync.Mutex
+	clock  Clock
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a rateLimiter allowing rate
+// events per second, with bursts of up to rate events.
+func newRateLimiter(rate int, clock Clock) *rateLimiter {
+	return &rateLimiter{
+		clock:  clock,
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   clock.Now(),
+	}
+}
+
+// Allow checks if an event may happen now, and consumes
+// a token if so.
+func (r *rateLimiter) Allow() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := r.clock.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
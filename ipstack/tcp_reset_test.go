@@ -0,0 +1,60 @@
+package ipstack
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCP4Reset(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 80}
+	raddr := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 1337}
+
+	syn := NewTCP4Packet(64, raddr, laddr, 1000, 0, 1024, nil, SYN)
+	reset := tcp4Reset(64, syn)
+	if reset.Header().SeqNum() != 0 || reset.Header().AckNum() != 1001 ||
+		!reset.Header().Flag(RST) || !reset.Header().Flag(ACK) {
+		t.Error("bad reset for SYN")
+	}
+	if !reset.SourceAddr().IP.Equal(laddr.IP) || reset.SourceAddr().Port != laddr.Port ||
+		!reset.DestAddr().IP.Equal(raddr.IP) || reset.DestAddr().Port != raddr.Port {
+		t.Error("bad reset addresses")
+	}
+
+	data := NewTCP4Packet(64, raddr, laddr, 1000, 5000, 1024, []byte("hi"), ACK)
+	reset = tcp4Reset(64, data)
+	if reset.Header().SeqNum() != 5000 || !reset.Header().Flag(RST) ||
+		reset.Header().Flag(ACK) {
+		t.Error("bad reset for ACK")
+	}
+
+	if tcp4Reset(64, NewTCP4Packet(64, raddr, laddr, 1000, 0, 0, nil, RST)) != nil {
+		t.Error("should not reset a RST")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	limiter := newRateLimiter(100, clock)
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow() {
+			t.Fatal("burst was limited")
+		}
+	}
+	if limiter.Allow() {
+		t.Fatal("burst was not limited")
+	}
+
+	// One token is replenished every 10ms.
+	clock.Advance(time.Millisecond * 5)
+	if limiter.Allow() {
+		t.Fatal("token was replenished early")
+	}
+	clock.Advance(time.Millisecond * 6)
+	if !limiter.Allow() {
+		t.Fatal("token was not replenished")
+	}
+	if limiter.Allow() {
+		t.Fatal("too many tokens were replenished")
+	}
+}
@@ -0,0 +1,117 @@
+package ipstack
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTCPInitialRTO is the default retransmission
+	// timeout used before any round-trip time has been
+	// measured.
+	DefaultTCPInitialRTO = time.Second
+
+	// DefaultTCPMinRTO and DefaultTCPMaxRTO are the default
+	// bounds on the retransmission timeout.
+	//
+	// The minimum is lower than the one second suggested
+	// by RFC 6298, matching most modern stacks.
+	DefaultTCPMinRTO = 200 * time.Millisecond
+	DefaultTCPMaxRTO = 60 * time.Second
+
+	// tcpClockGranularity is the G term from RFC 6298.
+	tcpClockGranularity = time.Millisecond
+)
+
+// A tcpRTOEstimator estimates the round-trip time of a
+// connection and computes retransmission timeouts, as
+// described in RFC 6298.
+//
+// It is safe to use a tcpRTOEstimator from multiple
+// Goroutines.
+type tcpRTOEstimator struct {
+	lock sync.Mutex
+
+	minRTO time.Duration
+	maxRTO time.Duration
+
+	hasSample bool
+	srtt      time.Duration
+	rttvar    time.Duration
+	rto       time.Duration
+
+	// The number of times the timeout has been doubled
+	// since the last sample.
+	backoff uint
+}
+
+func newTCPRTOEstimator(initial, min, max time.Duration) *tcpRTOEstimator {
+	return &tcpRTOEstimator{minRTO: min, maxRTO: max, rto: initial}
+}
+
+// AddSample updates the estimate with a new round-trip
+// time measurement.
+//
+// Measurements must not be taken from retransmitted
+// segments (Karn's algorithm).
+func (t *tcpRTOEstimator) AddSample(rtt time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.hasSample {
+		t.hasSample = true
+		t.srtt = rtt
+		t.rttvar = rtt / 2
+	} else {
+		diff := t.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		t.rttvar = (3*t.rttvar + diff) / 4
+		t.srtt = (7*t.srtt + rtt) / 8
+	}
+
+	variance := 4 * t.rttvar
+	if variance < tcpClockGranularity {
+		variance = tcpClockGranularity
+	}
+	t.rto = t.srtt + variance
+	t.backoff = 0
+}
+
+// Backoff doubles the timeout after a retransmission
+// timer expires.
+func (t *tcpRTOEstimator) Backoff() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.baseRTO()<<t.backoff < t.maxRTO {
+		t.backoff++
+	}
+}
+
+// RTO gets the current retransmission timeout.
+func (t *tcpRTOEstimator) RTO() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rto := t.baseRTO() << t.backoff
+	if rto > t.maxRTO {
+		rto = t.maxRTO
+	}
+	return rto
+}
+
+// baseRTO gets the timeout before backoff is applied.
+func (t *tcpRTOEstimator) baseRTO() time.Duration {
+	if t.rto < t.minRTO {
+		return t.minRTO
+	}
+	return t.rto
+}
+
+// SRTT gets the smoothed round-trip time.
+// It is 0 if no measurements have been taken.
+func (t *tcpRTOEstimator) SRTT() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.srtt
+}
@@ -0,0 +1,48 @@
+package ipstack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPRTOEstimator(t *testing.T) {
+	r := newTCPRTOEstimator(DefaultTCPInitialRTO, DefaultTCPMinRTO, DefaultTCPMaxRTO)
+	if r.RTO() != DefaultTCPInitialRTO || r.SRTT() != 0 {
+		t.Fatal("unexpected initial state")
+	}
+
+	r.AddSample(100 * time.Millisecond)
+	if r.SRTT() != 100*time.Millisecond {
+		t.Error("unexpected SRTT", r.SRTT())
+	}
+	if r.RTO() != 300*time.Millisecond {
+		t.Error("unexpected RTO", r.RTO())
+	}
+
+	r.AddSample(20 * time.Millisecond)
+	if r.SRTT() != 90*time.Millisecond {
+		t.Error("unexpected SRTT", r.SRTT())
+	}
+	// RTTVAR = 3/4*50ms + 1/4*80ms = 57.5ms
+	if r.RTO() != 320*time.Millisecond {
+		t.Error("unexpected RTO", r.RTO())
+	}
+
+	r.Backoff()
+	r.Backoff()
+	if r.RTO() != 1280*time.Millisecond {
+		t.Error("unexpected backoff", r.RTO())
+	}
+	for i := 0; i < 20; i++ {
+		r.Backoff()
+	}
+	if r.RTO() != DefaultTCPMaxRTO {
+		t.Error("unexpected maximum RTO", r.RTO())
+	}
+
+	r = newTCPRTOEstimator(DefaultTCPInitialRTO, DefaultTCPMinRTO, DefaultTCPMaxRTO)
+	r.AddSample(time.Microsecond)
+	if r.RTO() != DefaultTCPMinRTO {
+		t.Error("unexpected minimum RTO", r.RTO())
+	}
+}
@@ -0,0 +1,104 @@
+package ipstack
+
+import "github.com/unixpickle/essentials"
+
+// tcpMaxSACKBlocks is the maximum number of SACK blocks
+// that fit in a TCP header.
+const tcpMaxSACKBlocks = 4
+
+// tcpMaxSACKBlocksTimestamps is the maximum number of
+// SACK blocks that fit in a TCP header alongside the
+// timestamps option.
+const tcpMaxSACKBlocksTimestamps = 3
+
+// A tcpRange is a range of offsets into a buffer.
+// End is the first offset after the range.
+type tcpRange struct {
+	Start int
+	End   int
+}
+
+// A tcpRangeSet is a sorted list of disjoint ranges.
+// Adjacent ranges are always merged.
+//
+// Range sets are used to track which parts of a buffer
+// have been received or selectively acknowledged.
+type tcpRangeSet []tcpRange
+
+// Add adds a range to the set.
+// It returns the merged range containing the new range.
+func (t *tcpRangeSet) Add(start, end int) tcpRange {
+	if start >= end {
+		return tcpRange{Start: start, End: start}
+	}
+	merged := tcpRange{Start: start, End: end}
+	var res tcpRangeSet
+	var inserted bool
+	for _, r := range *t {
+		if r.End < merged.Start {
+			res = append(res, r)
+		} else if r.Start > merged.End {
+			if !inserted {
+				res = append(res, merged)
+				inserted = true
+			}
+			res = append(res, r)
+		} else {
+			if r.Start < merged.Start {
+				merged.Start = r.Start
+			}
+			if r.End > merged.End {
+				merged.End = r.End
+			}
+		}
+	}
+	if !inserted {
+		res = append(res, merged)
+	}
+	*t = res
+	return merged
+}
+
+// Shift subtracts n from every offset in the set,
+// dropping anything which ends up below zero.
+func (t *tcpRangeSet) Shift(n int) {
+	var res tcpRangeSet
+	for _, r := range *t {
+		r.Start -= n
+		r.End -= n
+		if r.End <= 0 {
+			continue
+		}
+		if r.Start < 0 {
+			r.Start = 0
+		}
+		res = append(res, r)
+	}
+	*t = res
+}
+
+// Find returns the range containing an offset.
+// The second return value is false if there is no such
+// range.
+func (t tcpRangeSet) Find(offset int) (tcpRange, bool) {
+	for _, r := range t {
+		if r.Start <= offset && offset < r.End {
+			return r, true
+		} else if r.Start > offset {
+			break
+		}
+	}
+	return tcpRange{}, false
+}
+
+// Count gets the number of offsets in [start, end) which
+// are covered by the set.
+func (t tcpRangeSet) Count(start, end int) int {
+	var res int
+	for _, r := range t {
+		if r.End > start && r.Start < end {
+			res += essentials.MinInt(r.End, end) - essentials.MaxInt(r.Start, start)
+		}
+	}
+	return res
+}
@@ -0,0 +1,892 @@
+package ipstack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpScriptRemoteISN is the initial sequence number of the
+// scripted remote host.
+const tcpScriptRemoteISN = 1000000
+
+// tcpScriptWait is how long a script waits, in real time,
+// for the network to do something.
+const tcpScriptWait = time.Second * 2
+
+// tcpScriptQuiet is how long a script watches, in real
+// time, for segments which it does not expect.
+//
+// A slow network can only make a check pass when it
+// should not, never the other way around, so this does
+// not make scripts flaky.
+const tcpScriptQuiet = time.Millisecond * 20
+
+// tcpScriptFlags maps flag characters to flags, in the
+// order they are written.
+var tcpScriptFlags = []struct {
+	char byte
+	flag Flag
+}{
+	{'S', SYN}, {'F', FIN}, {'R', RST}, {'P', PSH}, {'U', URG}, {'E', ECE}, {'W', CWR},
+	{'.', ACK},
+}
+
+// A tcpScript drives a TCPNet through a Pipe, playing the
+// role of a remote host in the style of packetdrill.
+//
+// Each line of a script is a command, optionally prefixed
+// by a duration like "+200ms" which the clock is advanced
+// by before the command runs. The clock is only advanced
+// once the network has a pending timer, so that timers
+// started by earlier commands count from the right time.
+// The commands are:
+//
+//	< FLAGS START:END(LEN) [ack N] [win N] [<OPTIONS>]
+//	> FLAGS START:END(LEN) [ack N] [win N] [<OPTIONS>]
+//	> none
+//	listen
+//	connect
+//	accept
+//	write N
+//	read N|eof|reset
+//	close
+//	state STATE
+//	rtt DURATION
+//
+// Lines starting with "<" inject a segment from the remote
+// host, and lines starting with ">" expect the next
+// segment from the network, or that nothing is sent for a
+// short while if the segment is "none". Since the network
+// handles segments in order, a later expectation also
+// shows that an earlier segment got no reply. Flags are written as in
+// tcpdump, e.g. "S." for SYN/ACK. Sequence numbers are
+// relative to the sender's ISN, and acknowledgement
+// numbers are relative to the receiver's ISN.
+// Options are a comma-separated list of "mss N", "wscale
+// N", "sackOK", "sack START:END ...", "ts VAL ECR", and
+// "nop". The network's timestamp values, and the echo
+// replies of injected segments, are relative to the
+// timestamp in the network's SYN.
+// Fields omitted from an expected segment are not
+// checked.
+//
+// Socket commands operate on the network's single
+// connection. Commands which block in a real socket
+// API run in the background, except for accept and read.
+type tcpScript struct {
+	t     *testing.T
+	line  int
+	clock *ManualClock
+
+	net    TCPNet
+	remote Stream
+	laddr  *net.TCPAddr
+	raddr  *net.TCPAddr
+
+	localISN  uint32
+	remoteISN uint32
+
+	// localTS is the timestamp value in the network's SYN.
+	localTS uint32
+
+	conns chan TCPConn
+	conn  TCPConn
+}
+
+// runTCPScript runs a script against a network created
+// with the given configuration.
+// The configuration's clock is replaced.
+func runTCPScript(t *testing.T, config *TCPConfig, script string) {
+	stream, remote := Pipe(100)
+	clock := NewManualClock(time.Unix(0, 0))
+	c := *config
+	c.Clock = clock
+	s := &tcpScript{
+		t:      t,
+		clock:  clock,
+		net:    NewTCP4NetConfig(stream, net.IP{10, 0, 0, 1}, nil, &c),
+		remote: remote,
+		laddr:  &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 80},
+		raddr:  &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 5000},
+
+		remoteISN: tcpScriptRemoteISN,
+
+		conns: make(chan TCPConn, 1),
+	}
+	defer s.net.Close()
+
+	for i, line := range strings.Split(script, "\n") {
+		s.line = i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "+") {
+			fields := strings.SplitN(line, " ", 2)
+			s.advance(fields[0][1:])
+			if len(fields) == 1 {
+				continue
+			}
+			line = strings.TrimSpace(fields[1])
+		}
+		s.run(line)
+	}
+
+	select {
+	case packet := <-s.remote.Incoming():
+		s.t.Fatalf("unexpected segment after script: %s", s.format(TCP4Packet(packet)))
+	case <-time.After(tcpScriptQuiet):
+	}
+}
+
+func (s *tcpScript) fatalf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf("line %d: %s", s.line, fmt.Sprintf(format, args...))
+}
+
+func (s *tcpScript) advance(duration string) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		s.fatalf("bad duration: %s", duration)
+	}
+	if d == 0 {
+		return
+	}
+	waited := make(chan struct{})
+	go func() {
+		s.clock.WaitTimers(1)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(tcpScriptWait):
+		s.fatalf("no timer to advance to")
+	}
+	s.clock.Advance(d)
+}
+
+func (s *tcpScript) run(line string) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "<":
+		s.inject(line[1:])
+	case ">":
+		s.expect(line[1:])
+	case "listen":
+		listener, err := s.net.ListenTCP(s.laddr)
+		if err != nil {
+			s.fatalf("listen: %s", err)
+		}
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				s.conns <- conn.(TCPConn)
+			}
+		}()
+	case "connect":
+		go func() {
+			if conn, err := s.net.DialTCP(s.raddr); err == nil {
+				s.conns <- conn
+			}
+		}()
+	case "accept":
+		s.getConn()
+	case "write":
+		conn := s.getConn()
+		go conn.Write(make([]byte, s.atoi(fields[1])))
+	case "read":
+		s.read(fields[1])
+	case "close":
+		go s.getConn().Close()
+	case "state":
+		s.waitState(fields[1])
+	case "rtt":
+		s.waitRTT(fields[1])
+	default:
+		s.fatalf("unknown command: %s", fields[0])
+	}
+}
+
+func (s *tcpScript) getConn() TCPConn {
+	if s.conn == nil {
+		select {
+		case s.conn = <-s.conns:
+		case <-time.After(tcpScriptWait):
+			s.fatalf("no connection")
+		}
+	}
+	return s.conn
+}
+
+func (s *tcpScript) read(arg string) {
+	conn := s.getConn()
+	var size int
+	if arg != "eof" && arg != "reset" {
+		size = s.atoi(arg)
+	}
+	res := make(chan error, 1)
+	go func() {
+		buf := make([]byte, size)
+		_, err := io.ReadFull(conn, buf)
+		if err == nil && size == 0 {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		res <- err
+	}()
+	var err error
+	select {
+	case err = <-res:
+	case <-time.After(tcpScriptWait):
+		s.fatalf("read timed out")
+	}
+	switch arg {
+	case "eof":
+		if err != io.EOF {
+			s.fatalf("expected EOF but got %v", err)
+		}
+	case "reset":
+		if err != ConnectionResetErr {
+			s.fatalf("expected reset but got %v", err)
+		}
+	default:
+		if err != nil {
+			s.fatalf("read: %s", err)
+		}
+	}
+}
+
+func (s *tcpScript) waitState(name string) {
+	conn := s.getConn()
+	timeout := time.After(tcpScriptWait)
+	for conn.State().String() != name {
+		select {
+		case <-timeout:
+			s.fatalf("expected state %s but got %s", name, conn.State())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (s *tcpScript) waitRTT(duration string) {
+	rtt, err := time.ParseDuration(duration)
+	if err != nil {
+		s.fatalf("bad duration: %s", duration)
+	}
+	conn := s.getConn()
+	timeout := time.After(tcpScriptWait)
+	for conn.RTT() != rtt {
+		select {
+		case <-timeout:
+			s.fatalf("expected RTT %s but got %s", rtt, conn.RTT())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func (s *tcpScript) inject(spec string) {
+	seg := s.parseSegment(spec)
+	seq := s.remoteISN + seg.start
+	ack := s.localISN + seg.ack
+	win := uint16(65535)
+	if seg.hasWin {
+		win = seg.win
+	}
+	var options []*TCPOption
+	for _, option := range seg.options {
+		if blocks, ok := option.SACKBlocks(); ok {
+			for i := range blocks {
+				blocks[i].Start += s.localISN
+				blocks[i].End += s.localISN
+			}
+			option = NewTCPOptionSACK(blocks)
+		} else if val, ecr, ok := option.Timestamps(); ok {
+			option = NewTCPOptionTimestamps(val, ecr+s.localTS)
+		}
+		options = append(options, option)
+	}
+	payload := bytes.Repeat([]byte{'x'}, int(seg.end-seg.start))
+	packet := NewTCP4PacketOptions(DefaultTTL, s.raddr, s.laddr, seq, ack, win, options,
+		payload, seg.flags...)
+	if err := Send(s.remote, packet); err != nil {
+		s.fatalf("inject: %s", err)
+	}
+}
+
+func (s *tcpScript) expect(spec string) {
+	if strings.TrimSpace(spec) == "none" {
+		select {
+		case packet := <-s.remote.Incoming():
+			s.fatalf("expected nothing but got %s", s.format(TCP4Packet(packet)))
+		case <-time.After(tcpScriptQuiet):
+		}
+		return
+	}
+
+	seg := s.parseSegment(spec)
+	var packet TCP4Packet
+	select {
+	case p := <-s.remote.Incoming():
+		packet = TCP4Packet(p)
+	case <-time.After(tcpScriptWait):
+		s.fatalf("expected segment but got nothing")
+	}
+
+	header := packet.Header()
+	if header.Flag(SYN) {
+		s.localISN = header.SeqNum()
+		if val, _, ok := tcpTimestampsOption(header); ok {
+			s.localTS = val
+		}
+		if !header.Flag(ACK) {
+			// The local port of an active open is only known
+			// once the SYN is sent.
+			s.laddr = packet.SourceAddr()
+		}
+	}
+
+	actual := s.parseSegment(s.format(packet))
+	mismatch := len(actual.flags) != len(seg.flags) || actual.start != seg.start ||
+		actual.end != seg.end || (seg.hasAck && actual.ack != seg.ack) ||
+		(seg.hasWin && actual.win != seg.win) ||
+		(seg.options != nil && !tcpScriptOptionsEqual(actual.options, seg.options))
+	for _, flag := range seg.flags {
+		mismatch = mismatch || !header.Flag(flag)
+	}
+	if mismatch {
+		s.fatalf("expected %s but got %s", strings.TrimSpace(spec), s.format(packet))
+	}
+}
+
+// format describes an outgoing segment in script syntax.
+func (s *tcpScript) format(packet TCP4Packet) string {
+	header := packet.Header()
+	var flags string
+	for _, f := range tcpScriptFlags {
+		if header.Flag(f.flag) {
+			flags += string(f.char)
+		}
+	}
+	start := header.SeqNum() - s.localISN
+	end := start + uint32(len(packet.Payload()))
+	res := fmt.Sprintf("%s %d:%d(%d)", flags, start, end, end-start)
+	if header.Flag(ACK) {
+		res += fmt.Sprintf(" ack %d", header.AckNum()-s.remoteISN)
+	}
+	res += fmt.Sprintf(" win %d", header.WindowSize())
+	options, _ := header.TCPOptions()
+	var optStrs []string
+	for _, option := range options {
+		if mss, ok := option.MSS(); ok {
+			optStrs = append(optStrs, fmt.Sprintf("mss %d", mss))
+		} else if shift, ok := option.WindowScale(); ok {
+			optStrs = append(optStrs, fmt.Sprintf("wscale %d", shift))
+		} else if option.Kind == TCPOptionSACKPermit {
+			optStrs = append(optStrs, "sackOK")
+		} else if blocks, ok := option.SACKBlocks(); ok {
+			str := "sack"
+			for _, block := range blocks {
+				str += fmt.Sprintf(" %d:%d", block.Start-s.remoteISN, block.End-s.remoteISN)
+			}
+			optStrs = append(optStrs, str)
+		} else if val, ecr, ok := option.Timestamps(); ok {
+			optStrs = append(optStrs, fmt.Sprintf("ts %d %d", val-s.localTS, ecr))
+		}
+	}
+	if len(optStrs) > 0 {
+		res += " <" + strings.Join(optStrs, ",") + ">"
+	}
+	return res
+}
+
+type tcpScriptSegment struct {
+	flags      []Flag
+	start, end uint32
+	ack        uint32
+	hasAck     bool
+	win        uint16
+	hasWin     bool
+
+	// Non-nil if options were specified.
+	options []*TCPOption
+}
+
+func (s *tcpScript) parseSegment(spec string) *tcpScriptSegment {
+	res := &tcpScriptSegment{}
+	if idx := strings.Index(spec, "<"); idx >= 0 {
+		optSpec := strings.TrimSuffix(strings.TrimSpace(spec[idx+1:]), ">")
+		spec = spec[:idx]
+		res.options = []*TCPOption{}
+		if optSpec != "" {
+			for _, opt := range strings.Split(optSpec, ",") {
+				res.options = append(res.options, s.parseOption(strings.Fields(opt)))
+			}
+		}
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		s.fatalf("bad segment: %s", spec)
+	}
+	for i := 0; i < len(fields[0]); i++ {
+		found := false
+		for _, f := range tcpScriptFlags {
+			if f.char == fields[0][i] {
+				res.flags = append(res.flags, f.flag)
+				found = true
+			}
+		}
+		if !found {
+			s.fatalf("bad flags: %s", fields[0])
+		}
+	}
+
+	var length uint32
+	if _, err := fmt.Sscanf(fields[1], "%d:%d(%d)", &res.start, &res.end, &length); err != nil ||
+		res.end-res.start != length {
+		s.fatalf("bad sequence range: %s", fields[1])
+	}
+
+	for i := 2; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			s.fatalf("missing value for %s", fields[i])
+		}
+		switch fields[i] {
+		case "ack":
+			res.ack, res.hasAck = uint32(s.atoi(fields[i+1])), true
+		case "win":
+			res.win, res.hasWin = uint16(s.atoi(fields[i+1])), true
+		default:
+			s.fatalf("unknown field: %s", fields[i])
+		}
+	}
+	return res
+}
+
+func (s *tcpScript) parseOption(fields []string) *TCPOption {
+	if len(fields) == 0 {
+		s.fatalf("empty option")
+	}
+	switch fields[0] {
+	case "mss":
+		if len(fields) == 2 {
+			return NewTCPOptionMSS(uint16(s.atoi(fields[1])))
+		}
+	case "wscale":
+		if len(fields) == 2 {
+			return NewTCPOptionWindowScale(uint8(s.atoi(fields[1])))
+		}
+	case "sackOK":
+		return NewTCPOptionSACKPermit()
+	case "nop":
+		return &TCPOption{Kind: TCPOptionNop}
+	case "ts":
+		if len(fields) == 3 {
+			return NewTCPOptionTimestamps(uint32(s.atoi(fields[1])), uint32(s.atoi(fields[2])))
+		}
+	case "sack":
+		var blocks []TCPSACKBlock
+		for _, field := range fields[1:] {
+			var block TCPSACKBlock
+			if _, err := fmt.Sscanf(field, "%d:%d", &block.Start, &block.End); err != nil {
+				s.fatalf("bad SACK block: %s", field)
+			}
+			blocks = append(blocks, block)
+		}
+		return NewTCPOptionSACK(blocks)
+	}
+	s.fatalf("bad option: %s", strings.Join(fields, " "))
+	return nil
+}
+
+func (s *tcpScript) atoi(str string) int {
+	res, err := strconv.Atoi(str)
+	if err != nil {
+		s.fatalf("bad number: %s", str)
+	}
+	return res
+}
+
+// tcpScriptOptionsEqual compares options, ignoring their
+// order and padding.
+func tcpScriptOptionsEqual(actual, expected []*TCPOption) bool {
+	var a, e []string
+	for _, option := range actual {
+		if option.Kind > TCPOptionNop {
+			a = append(a, string(option.Encode()))
+		}
+	}
+	for _, option := range expected {
+		if option.Kind > TCPOptionNop {
+			e = append(e, string(option.Encode()))
+		}
+	}
+	if len(a) != len(e) {
+		return false
+	}
+	for _, x := range e {
+		found := false
+		for i, y := range a {
+			if x == y {
+				a = append(a[:i], a[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// tcpScriptAccept establishes a connection through a
+// listener, with a remote MSS of 1000 and no other
+// options.
+const tcpScriptAccept = `
+	listen
+	< S 0:0(0) win 65535 <mss 1000>
+	> S. 0:0(0) ack 1 <mss 1460>
+	< . 1:1(0) ack 1 win 10000
+	accept
+`
+
+func TestTCPScripts(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TCPConfig
+		script string
+	}{
+		{
+			name: "PassiveOpen",
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000,sackOK,wscale 2>
+				> S. 0:0(0) ack 1 win 65535 <mss 1460,sackOK,wscale 1>
+				< . 1:1(0) ack 1 win 1000
+				accept
+				state ESTABLISHED
+			`,
+		},
+		{
+			name: "ActiveOpen",
+			script: `
+				connect
+				> S 0:0(0) win 65535 <mss 1460,sackOK,wscale 1>
+				< S. 0:0(0) ack 1 win 5000 <mss 1000>
+				> . 1:1(0) ack 1
+				state ESTABLISHED
+			`,
+		},
+		{
+			name: "SYNReceivedChallengeAck",
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000>
+				> S. 0:0(0) ack 1 <mss 1460>
+				< R. 1000:1000(0) ack 1
+				> . 1:1(0) ack 1
+				< . 1:1(0) ack 1 win 10000
+				accept
+				state ESTABLISHED
+			`,
+		},
+		{
+			name: "SYNReceivedReset",
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000>
+				> S. 0:0(0) ack 1 <mss 1460>
+				< R. 1:1(0) ack 1
+				> none
+				< . 1:1(0) ack 1 win 10000
+				> R 1:1(0)
+			`,
+		},
+		{
+			name: "SYNRetransmit",
+			script: `
+				connect
+				> S 0:0(0)
+				+999ms > none
+				+1ms > S 0:0(0)
+				+2s > S 0:0(0)
+				< S. 0:0(0) ack 1 win 5000 <mss 1000>
+				> . 1:1(0) ack 1
+				state ESTABLISHED
+			`,
+		},
+		{
+			name: "ClosedPort",
+			script: `
+				< S 0:0(0) win 65535
+				> R. 0:0(0) ack 1
+			`,
+		},
+		{
+			name: "Retransmit",
+			script: tcpScriptAccept + `
+				write 1000
+				> . 1:1001(1000) ack 1
+				+999ms > none
+				+1ms > . 1:1001(1000) ack 1
+				+2s > . 1:1001(1000) ack 1
+				< . 1:1(0) ack 1001 win 10000
+			`,
+		},
+		{
+			name: "FastRetransmit",
+			script: tcpScriptAccept + `
+				write 4000
+				> . 1:1001(1000) ack 1
+				> . 1001:2001(1000) ack 1
+				> . 2001:3001(1000) ack 1
+				> . 3001:4001(1000) ack 1
+				< . 1:1(0) ack 1001 win 10000
+				< . 1:1(0) ack 1001 win 10000
+				< . 1:1(0) ack 1001 win 10000
+				> none
+				< . 1:1(0) ack 1001 win 10000
+				> . 1001:2001(1000) ack 1
+				< . 1:1(0) ack 4001 win 10000
+			`,
+		},
+		{
+			name: "DelayedAck",
+			script: tcpScriptAccept + `
+				< . 1:101(100) ack 1 win 10000
+				> none
+				+40ms > . 1:1(0) ack 101
+				< . 101:201(100) ack 1 win 10000
+				< . 201:301(100) ack 1 win 10000
+				> . 1:1(0) ack 301
+				read 300
+			`,
+		},
+		{
+			name: "ZeroWindowProbe",
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000>
+				> S. 0:0(0) ack 1 <mss 1460>
+				< . 1:1(0) ack 1 win 0
+				accept
+				write 10
+				> none
+				+1s > . 1:2(1) ack 1
+				< . 1:1(0) ack 1 win 0
+				+2s > . 1:2(1) ack 1
+				< . 1:1(0) ack 2 win 1000
+				> . 2:11(9) ack 1
+				< . 1:1(0) ack 11 win 1000
+			`,
+		},
+		{
+			name:   "ZeroReceiveWindow",
+			config: TCPConfig{RecvBuffer: 2000},
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000>
+				> S. 0:0(0) ack 1 win 2000 <mss 1460>
+				< . 1:1(0) ack 1 win 10000
+				accept
+				< . 1:1001(1000) ack 1 win 10000
+				< . 1001:2001(1000) ack 1 win 10000
+				> . 1:1(0) ack 2001 win 0
+				read 2000
+				> . 1:1(0) ack 2001 win 2000
+			`,
+		},
+		{
+			name: "ActiveClose",
+			script: tcpScriptAccept + `
+				close
+				> F. 1:1(0) ack 1
+				state FIN-WAIT-1
+				< . 1:1(0) ack 2 win 10000
+				state FIN-WAIT-2
+				< F. 1:1(0) ack 2 win 10000
+				> . 2:2(0) ack 2
+				state TIME-WAIT
+				+59s state TIME-WAIT
+				+1s state CLOSED
+			`,
+		},
+		{
+			name: "KeepAlive",
+			config: TCPConfig{
+				KeepAlive: TCPKeepAlive{Idle: time.Second, Interval: time.Second, Count: 3},
+			},
+			script: tcpScriptAccept + `
+				+1s > . 0:0(0) ack 1
+				< . 1:1(0) ack 1 win 10000
+				< . 0:0(0) ack 1 win 10000
+				> . 1:1(0) ack 1
+				+1s > . 0:0(0) ack 1
+				+1s > . 0:0(0) ack 1
+				+1s > . 0:0(0) ack 1
+				state ESTABLISHED
+				+1s > R. 1:1(0) ack 1
+				state CLOSED
+			`,
+		},
+		{
+			name: "FinWait2Timeout",
+			script: tcpScriptAccept + `
+				close
+				> F. 1:1(0) ack 1
+				< . 1:1(0) ack 2 win 10000
+				state FIN-WAIT-2
+				+59s state FIN-WAIT-2
+				+1s > R. 2:2(0) ack 1
+				state CLOSED
+			`,
+		},
+		{
+			name: "PassiveClose",
+			script: tcpScriptAccept + `
+				< F. 1:1(0) ack 1 win 10000
+				> . 1:1(0) ack 2
+				read eof
+				state CLOSE-WAIT
+				close
+				> F. 1:1(0) ack 2
+				state LAST-ACK
+				< . 2:2(0) ack 2 win 10000
+				state CLOSED
+			`,
+		},
+		{
+			name: "Reset",
+			script: tcpScriptAccept + `
+				< R. 1:1(0) ack 1
+				read reset
+				state CLOSED
+			`,
+		},
+		{
+			name: "ResetOutOfWindow",
+			script: tcpScriptAccept + `
+				< R. 100000:100000(0) ack 1
+				> none
+				< . 100000:100100(100) ack 1 win 10000
+				> . 1:1(0) ack 1
+				state ESTABLISHED
+			`,
+		},
+		{
+			name:   "TimestampsPassive",
+			config: TCPConfig{Timestamps: true},
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000,ts 100 0>
+				> S. 0:0(0) ack 1 <mss 1460,ts 0 100>
+				< . 1:1(0) ack 1 win 10000 <ts 101 0>
+				accept
+				write 1000
+				> . 1:989(988) ack 1 <ts 0 101>
+				+30ms < . 1:1(0) ack 989 win 10000 <ts 130 0>
+				rtt 30ms
+				> . 989:1001(12) ack 1 <ts 30 130>
+				< . 1:1(0) ack 1001 win 10000 <ts 131 30>
+			`,
+		},
+		{
+			name:   "TimestampsActive",
+			config: TCPConfig{Timestamps: true},
+			script: `
+				connect
+				> S 0:0(0) <mss 1460,sackOK,wscale 1,ts 0 0>
+				< S. 0:0(0) ack 1 win 5000 <mss 1000,ts 500 0>
+				> . 1:1(0) ack 1 <ts 0 500>
+				write 100
+				> . 1:101(100) ack 1 <ts 0 500>
+			`,
+		},
+		{
+			name:   "TimestampsNotOffered",
+			config: TCPConfig{Timestamps: true},
+			script: `
+				connect
+				> S 0:0(0) <mss 1460,sackOK,wscale 1,ts 0 0>
+				< S. 0:0(0) ack 1 win 5000 <mss 1000>
+				> . 1:1(0) ack 1 <>
+				write 1000
+				> . 1:1001(1000) ack 1 <>
+			`,
+		},
+		{
+			name: "TimestampsDisabled",
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000,ts 100 0>
+				> S. 0:0(0) ack 1 <mss 1460>
+			`,
+		},
+		{
+			name:   "PAWS",
+			config: TCPConfig{Timestamps: true, AckDelay: -1},
+			script: `
+				listen
+				< S 0:0(0) win 65535 <mss 1000,ts 100 0>
+				> S. 0:0(0) ack 1 <mss 1460,ts 0 100>
+				< . 1:1(0) ack 1 win 10000 <ts 101 0>
+				accept
+				< . 1:101(100) ack 1 win 10000 <ts 90 0>
+				> . 1:1(0) ack 1 <ts 0 101>
+				< . 1:101(100) ack 1 win 10000
+				> none
+				< . 1:101(100) ack 1 win 10000 <ts 102 0>
+				> . 1:1(0) ack 101 <ts 0 102>
+				read 100
+			`,
+		},
+		{
+			name: "ResetInWindow",
+			script: tcpScriptAccept + `
+				< R. 500:500(0) ack 1
+				> . 1:1(0) ack 1
+				state ESTABLISHED
+				< R. 1:1(0) ack 1
+				read reset
+				state CLOSED
+			`,
+		},
+		{
+			name: "SYNEstablished",
+			script: tcpScriptAccept + `
+				< S 50000:50000(0) win 65535 <mss 1000>
+				> . 1:1(0) ack 1
+				< S 0:0(0) win 65535 <mss 1000>
+				> . 1:1(0) ack 1
+				state ESTABLISHED
+			`,
+		},
+		{
+			name: "UnacceptableData",
+			script: tcpScriptAccept + `
+				< . 100000:100100(100) ack 1 win 10000
+				> . 1:1(0) ack 1
+				< . 0:0(0) ack 1 win 10000
+				> . 1:1(0) ack 1
+				< . 1:101(100) ack 1 win 10000
+				+200ms
+				> . 1:1(0) ack 101
+				< . 1:101(100) ack 1 win 10000
+				> . 1:1(0) ack 101
+				< . 51:151(100) ack 1 win 10000
+				> . 1:1(0) ack 151
+				read 150
+			`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runTCPScript(t, &test.config, test.script)
+		})
+	}
+}
@@ -4,39 +4,97 @@ import (
 	"io"
 	"sync"
 	"time"
+
+	"github.com/unixpickle/essentials"
 )
 
+// DefaultTCPRetransmits is the default number of times
+// that data is retransmitted after consecutive timeouts
+// before a connection fails. With exponential backoff,
+// this gives up after roughly ten minutes.
+const DefaultTCPRetransmits = 15
+
+var retransmitTimeoutErr = &timeoutError{Context: "retransmit"}
+
 // A tcpSend manages the sending end of TCP.
 //
-// Write(), Close(), and SetDeadline() may be called from
-// any Goroutine. All other methods should only be called
-// one at a time.
+// Write(), CloseWrite(), Wait(), and SetDeadline() may be
+// called from any Goroutine. All other methods should
+// only be called one at a time.
 type tcpSend interface {
-	// Write writes all of the data to the connection, or
-	// yields an error caused by Fail().
+	// Write copies all of the data into the send buffer,
+	// blocking while the buffer is full, or yields an error
+	// caused by Fail().
 	Write(b []byte) (int, error)
 
-	// Close triggers an EOF sequence.
-	Close() error
+	// WriteUrgent is like Write, but marks the data as
+	// urgent.
+	WriteUrgent(b []byte) (int, error)
+
+	// CloseWrite queues an EOF after the buffered data.
+	// Subsequent writes fail, as do writes which are
+	// blocked waiting for buffer space, and further calls
+	// have no effect.
+	CloseWrite() error
+
+	// Wait blocks until all of the data and the EOF are
+	// acknowledged, or yields an error caused by Fail().
+	Wait() error
 
 	// SetDeadline sets the deadline for all writes.
 	SetDeadline(t time.Time)
 
-	// Handle updates the sender's state based on the ack
-	// and window size. This may trigger new packets to be
-	// sent to Next().
-	Handle(ack uint32, window uint16)
+	// Handle updates the sender's state based on the ack,
+	// window size, and SACK blocks. This may trigger new
+	// packets to be sent to Next().
+	//
+	// The hasData argument indicates that the segment
+	// carried data or a FIN, in which case it is never
+	// treated as a duplicate ack.
+	Handle(ack uint32, window uint32, sack []TCPSACKBlock, hasData bool)
+
+	// HandleTimestampRTT takes a round-trip time
+	// measurement from an echoed timestamp, if the ack
+	// acknowledges new data. It must be called before
+	// Handle for the same segment.
+	HandleTimestampRTT(ack uint32, rtt time.Duration)
+
+	// HandleECE reduces the congestion window in response
+	// to an ECN-Echo, at most once per window of data.
+	HandleECE()
 
 	// Fail triggers an error for all subsequent writes.
 	Fail(err error)
 
-	// Next is a channel of desired outgoing segments.
-	// Not reading this will cause segments to be dropped.
+	// TimedOut gets a channel which is closed if the
+	// sender gives up on retransmitting data, after which
+	// writes fail with a timeout.
+	TimedOut() <-chan struct{}
+
+	// Next gets a channel of outgoing segments.
+	// It should be called again after every read, since
+	// the next segment may not be queued until then.
 	Next() <-chan *tcpSegment
 
-	// Seq gets the first sequence number not sent.
+	// Seq gets the first sequence number which has never
+	// been sent.
 	Seq() uint32
 
+	// SetCongestionControl replaces the congestion
+	// controller with a new one created by cc.
+	SetCongestionControl(cc CongestionControl)
+
+	// SetNoDelay disables Nagle's algorithm if noDelay is
+	// true, so that small segments are sent immediately.
+	SetNoDelay(noDelay bool)
+
+	// RTT gets the smoothed round-trip time estimate, or
+	// 0 if no round-trip time has been measured.
+	RTT() time.Duration
+
+	// RecoveryStats gets loss recovery counters.
+	RecoveryStats() TCPRecoveryStats
+
 	// Done checks if the sender has no more segments to
 	// send.
 	Done() bool
@@ -48,114 +106,329 @@ type simpleTcpSend struct {
 	writeLock sync.Mutex
 	lock      sync.Mutex
 	notify    chan struct{}
+	next      chan *tcpSegment
 	writeBuf  *tcpWriteBuffer
 	timer     *tcpSendTimer
 	failErr   error
-	window    uint16
 	deadline  *deadlineManager
+	rto       *tcpRTOEstimator
+	clock     Clock
+
+	congestion CongestionController
+
+	// The receive window of the remote end, and the
+	// largest window it has ever advertised.
+	window    uint32
+	maxWindow uint32
+
+	// The sequence number after the last byte sent.
+	sentSeq uint32
+
+	// Segments which have been sent but not acknowledged,
+	// in sequence order.
+	inFlight []*tcpSentSegment
+
+	// If probe is set, a byte is sent even if the remote
+	// window is closed.
+	probe bool
+
+	// If noDelay is set, small segments are sent even if
+	// there is unacknowledged data.
+	noDelay bool
+
+	// If hasUrgent is set, urgentEnd is the sequence
+	// number after the last urgent byte.
+	hasUrgent bool
+	urgentEnd uint32
+
+	// Fast recovery state from RFC 6582.
+	// The inflation is the number of bytes which duplicate
+	// acks indicate have left the network.
+	dupAcks    int
+	recovering bool
+	recover    uint32
+	inflation  int
+
+	// Segments below highRxt have already been marked as
+	// lost during this recovery, like HighRxt in RFC 6675.
+	highRxt uint32
+
+	// If retransmitNow is set, the next lost segment is
+	// retransmitted regardless of the congestion window.
+	retransmitNow bool
+
+	// ECN-Echo flags are ignored until ecnRecover is
+	// acknowledged. If sendCWR is set, the next new data
+	// segment is marked with CWR.
+	ecnRecover uint32
+	sendCWR    bool
+
+	// The number of consecutive timeouts without progress,
+	// and the limit after which the sender gives up.
+	retries    int
+	maxRetries int
+	timedOut   chan struct{}
+
+	// If timestampRTT is set, round-trip times are taken
+	// from echoed timestamps rather than by timing
+	// segments.
+	timestampRTT bool
+
+	stats TCPRecoveryStats
 }
 
-func newSimpleTcpSend(startSeq uint32, window, mss uint16) *simpleTcpSend {
-	return &simpleTcpSend{
+// newSimpleTcpSend creates a simpleTcpSend which uses the
+// send buffer, timeouts, congestion control, and Nagle
+// setting from a configuration with defaults filled in.
+func newSimpleTcpSend(startSeq, window uint32, mss uint16,
+	config *TCPConfig) *simpleTcpSend {
+	res := &simpleTcpSend{
 		maxSegmentSize: mss,
 		notify:         make(chan struct{}),
-		writeBuf:       newTCPWriteBuffer(startSeq),
-		timer:          newTcpSendTimer(),
+		next:           make(chan *tcpSegment, 1),
+		writeBuf:       newTCPWriteBuffer(startSeq, config.SendBuffer),
+		deadline:       newDeadlineManager(config.Clock),
+		rto:            newTCPRTOEstimator(config.InitialRTO, config.MinRTO, config.MaxRTO),
+		clock:          config.Clock,
+		congestion:     newCongestionController(config.CongestionControl, int(mss), config.Clock),
 		window:         window,
-		deadline:       newDeadlineManager(),
+		maxWindow:      window,
+		sentSeq:        startSeq,
+		noDelay:        config.NoDelay,
+		maxRetries:     config.Retransmits,
+		timedOut:       make(chan struct{}),
+		recover:        startSeq - 1,
+		ecnRecover:     startSeq,
 	}
+	res.timer = newTcpSendTimer(&res.lock, config.Clock, res.rto, res.handleTimeout)
+	return res
 }
 
 func (s *simpleTcpSend) Write(b []byte) (int, error) {
-	if len(b) == 0 {
-		return 0, nil
-	}
-	return s.writeOrClose(b, false)
+	return s.write(b, false)
 }
 
-func (s *simpleTcpSend) Close() error {
-	_, err := s.writeOrClose(nil, true)
-	return err
+func (s *simpleTcpSend) WriteUrgent(b []byte) (int, error) {
+	return s.write(b, true)
 }
 
-func (s *simpleTcpSend) writeOrClose(data []byte, close bool) (int, error) {
+func (s *simpleTcpSend) write(b []byte, urgent bool) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
 	s.writeLock.Lock()
 	defer s.writeLock.Unlock()
 
-	if !close {
+	var n int
+	for {
 		select {
 		case <-s.deadline.Chan():
-			return 0, writeTimeoutErr
+			return n, writeTimeoutErr
 		default:
 		}
-	}
 
-	s.lock.Lock()
-
-	if s.writeBuf.sendEOF {
-		s.lock.Unlock()
-		return 0, io.ErrClosedPipe
-	} else if s.failErr != nil {
+		s.lock.Lock()
+		if s.writeBuf.sendEOF {
+			s.lock.Unlock()
+			return n, io.ErrClosedPipe
+		} else if s.failErr != nil {
+			s.lock.Unlock()
+			return n, s.failErr
+		}
+		n += s.writeBuf.Append(b[n:])
+		if urgent {
+			s.hasUrgent = true
+			s.urgentEnd = s.writeBuf.sequence + uint32(len(s.writeBuf.buffer))
+		}
+		s.fill()
+		notify := s.notify
 		s.lock.Unlock()
-		return 0, s.failErr
-	}
-
-	if close {
-		s.writeBuf.SetEOF()
-	} else {
-		s.writeBuf.SetData(data)
-	}
-	s.sendNext()
 
-	notify := s.notify
-	s.lock.Unlock()
+		if n == len(b) {
+			return n, nil
+		}
 
-	select {
-	case <-notify:
-	case <-s.deadline.Chan():
-		return 0, writeTimeoutErr
+		// Wait for acknowledgements to free up space.
+		select {
+		case <-notify:
+		case <-s.deadline.Chan():
+			return n, writeTimeoutErr
+		}
 	}
+}
 
+func (s *simpleTcpSend) CloseWrite() error {
+	// The write lock is not held, since a blocked write
+	// holds it until buffer space frees up.
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	if s.failErr != nil {
-		return len(data) - len(s.writeBuf.buffer), s.failErr
+		return s.failErr
+	}
+	if !s.writeBuf.sendEOF {
+		s.writeBuf.SetEOF()
+		s.fill()
+
+		// Wake up blocked writes so that they fail.
+		close(s.notify)
+		s.notify = make(chan struct{})
+	}
+	return nil
+}
+
+func (s *simpleTcpSend) Wait() error {
+	s.lock.Lock()
+	for s.writeBuf.Remaining() > 0 && s.failErr == nil {
+		notify := s.notify
+		s.lock.Unlock()
+		select {
+		case <-notify:
+		case <-s.deadline.Chan():
+			return writeTimeoutErr
+		}
+		s.lock.Lock()
 	}
-	return len(data), nil
+	defer s.lock.Unlock()
+	return s.failErr
 }
 
 func (s *simpleTcpSend) SetDeadline(t time.Time) {
 	s.deadline.SetDeadline(t)
 }
 
-func (s *simpleTcpSend) Handle(ack uint32, window uint16) {
+func (s *simpleTcpSend) Handle(ack uint32, window uint32, sack []TCPSACKBlock,
+	hasData bool) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	s.writeBuf.Handle(ack)
+
+	una := s.writeBuf.sequence
+	if tcpSeqLess(ack, una) || tcpSeqLess(s.sentSeq, ack) {
+		// Old or bogus acknowledgement.
+		return
+	}
+
+	dup := ack == una && !hasData && window == s.window && s.sentSeq != una
+
+	// Progress, or an answer to a window probe, shows that
+	// the remote end is still alive.
+	if ack != una || window == 0 {
+		s.retries = 0
+	}
+
 	s.window = window
-	s.sendNext()
-	if s.writeBuf.Remaining() == 0 {
+	if window > s.maxWindow {
+		s.maxWindow = window
+	}
+
+	for _, block := range sack {
+		// Never trust the peer to SACK unsent data.
+		if !tcpSeqLess(s.sentSeq, block.End) {
+			s.writeBuf.HandleSACK([]TCPSACKBlock{block})
+		}
+	}
+
+	if ack != una {
+		s.writeBuf.Handle(ack)
+		s.handleAck(ack)
+		if s.recovering {
+			s.handleRecoveryAck(ack, int(ack-una))
+		} else {
+			s.dupAcks = 0
+			s.congestion.OnAck(int(ack-una), s.rto.SRTT())
+		}
+		if len(s.inFlight) == 0 {
+			s.timer.Stop()
+		} else {
+			s.timer.Start()
+		}
+	} else if dup {
+		s.handleDupAck(ack)
+	}
+
+	s.fill()
+	if ack != una {
 		close(s.notify)
 		s.notify = make(chan struct{})
 	}
 }
 
+func (s *simpleTcpSend) HandleTimestampRTT(ack uint32, rtt time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Unlike timed segments, echoed timestamps are never
+	// ambiguous, even for retransmissions.
+	if tcpSeqLess(s.writeBuf.sequence, ack) && !tcpSeqLess(s.sentSeq, ack) {
+		s.rto.AddSample(rtt)
+	}
+}
+
+func (s *simpleTcpSend) HandleECE() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	una := s.writeBuf.sequence
+	if s.recovering || tcpSeqLess(una, s.ecnRecover) {
+		return
+	}
+	s.congestion.OnLoss(int(s.sentSeq - una))
+	s.ecnRecover = s.sentSeq
+	s.sendCWR = true
+}
+
 func (s *simpleTcpSend) Fail(err error) {
 	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fail(err)
+}
+
+func (s *simpleTcpSend) TimedOut() <-chan struct{} {
+	return s.timedOut
+}
+
+// fail is like Fail, but the caller must hold the lock.
+func (s *simpleTcpSend) fail(err error) {
 	s.failErr = err
+	s.timer.Stop()
 	close(s.notify)
 	s.notify = make(chan struct{})
-	s.lock.Unlock()
 }
 
 func (s *simpleTcpSend) Next() <-chan *tcpSegment {
-	return s.timer.Chan()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fill()
+	return s.next
 }
 
 func (s *simpleTcpSend) Seq() uint32 {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	return s.writeBuf.sequence
+	return s.sentSeq
+}
+
+func (s *simpleTcpSend) SetCongestionControl(cc CongestionControl) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.congestion = newCongestionController(cc, int(s.maxSegmentSize), s.clock)
+	s.fill()
+}
+
+func (s *simpleTcpSend) SetNoDelay(noDelay bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.noDelay = noDelay
+	s.fill()
+}
+
+func (s *simpleTcpSend) RTT() time.Duration {
+	return s.rto.SRTT()
+}
+
+func (s *simpleTcpSend) RecoveryStats() TCPRecoveryStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stats
 }
 
 func (s *simpleTcpSend) Done() bool {
@@ -164,65 +437,281 @@ func (s *simpleTcpSend) Done() bool {
 	return s.writeBuf.sentEOF || s.failErr != nil
 }
 
-func (s *simpleTcpSend) sendNext() {
-	s.timer.Cancel()
+// handleAck removes acknowledged segments from the
+// in-flight list and takes a round-trip measurement.
+func (s *simpleTcpSend) handleAck(ack uint32) {
+	var acked *tcpSentSegment
+	var ambiguous bool
+	for len(s.inFlight) > 0 && !tcpSeqLess(ack, s.inFlight[0].End) {
+		acked = s.inFlight[0]
+		ambiguous = ambiguous || acked.Retransmitted
+		s.inFlight = s.inFlight[1:]
+	}
+	if len(s.inFlight) > 0 && tcpSeqLess(s.inFlight[0].Start, ack) {
+		s.inFlight[0].Start = ack
+	}
+
+	// Karn's algorithm: an ack covering a retransmitted
+	// segment yields an ambiguous measurement.
+	if acked != nil && !ambiguous && !s.timestampRTT {
+		s.rto.AddSample(s.clock.Now().Sub(acked.SentAt))
+	}
+}
 
-	if s.writeBuf.Remaining() == 0 {
+func (s *simpleTcpSend) handleTimeout() {
+	if s.failErr != nil {
 		return
 	}
+	if len(s.inFlight) > 0 {
+		s.retries++
+		if s.retries > s.maxRetries {
+			s.fail(retransmitTimeoutErr)
+			close(s.timedOut)
+			return
+		}
+	}
+	s.rto.Backoff()
+	if len(s.inFlight) > 0 {
+		s.stats.Timeouts++
+		s.exitRecovery()
+		s.recover = s.sentSeq
+		s.congestion.OnTimeout(int(s.sentSeq - s.writeBuf.sequence))
+		for _, seg := range s.inFlight {
+			seg.Lost = true
+		}
+		s.timer.Start()
+	} else {
+		s.probe = true
+	}
+	s.fill()
+}
 
-	if s.window == 0 {
-		// "Persist timer" to prevent deadlock.
-		s.timer.Schedule(s.writeBuf.Segment(1))
+// fill makes the next outgoing segment available on the
+// next channel, if there is room for it.
+//
+// A segment is considered sent once it is in the
+// channel.
+func (s *simpleTcpSend) fill() {
+	if s.failErr != nil || len(s.next) > 0 {
+		return
+	}
+	seg := s.retransmitSegment()
+	if seg == nil {
+		seg = s.newSegment()
+	}
+	if seg == nil {
 		return
 	}
+	if s.hasUrgent && tcpSeqLess(seg.Start, s.urgentEnd) {
+		seg.Urgent = s.urgentEnd - seg.Start
+	}
+	if s.sendCWR && !seg.Retransmit && len(seg.Data) > 0 {
+		seg.CWR = true
+		s.sendCWR = false
+	}
+	s.next <- seg
+	if !s.timer.Running() {
+		s.timer.Start()
+	}
+}
 
-	max := s.window
-	if max > s.maxSegmentSize {
-		max = s.maxSegmentSize
+// retransmitSegment produces the first segment which has
+// been lost and not selectively acknowledged, if the
+// congestion window allows it.
+func (s *simpleTcpSend) retransmitSegment() *tcpSegment {
+	if s.congestionRoom() == 0 && !s.retransmitNow {
+		return nil
 	}
-	s.timer.Send(s.writeBuf.Segment(max))
+	s.retransmitNow = false
+	for i := 0; i < len(s.inFlight); i++ {
+		sent := s.inFlight[i]
+		if !sent.Lost {
+			continue
+		}
+		sent.Lost = false
+		seg := s.writeBuf.Segment(sent.Start, sent.End)
+		if seg == nil {
+			continue
+		}
+		sent.Start = seg.Start
+		sent.SentAt = s.clock.Now()
+		sent.Retransmitted = true
+		seg.Retransmit = true
+		s.stats.Retransmits++
+		if end := seg.End(); end != sent.End {
+			// Part of the segment was selectively acked, so
+			// the rest must be retransmitted separately.
+			rest := &tcpSentSegment{Start: end, End: sent.End, Lost: true}
+			sent.End = end
+			s.inFlight = append(s.inFlight[:i+1],
+				append([]*tcpSentSegment{rest}, s.inFlight[i+1:]...)...)
+		}
+		return seg
+	}
+	return nil
 }
 
-// A tcpWriteBuffer maintains information about the
-// current outgoing chunk of data for a simpleTcpsend.
-// The outgoing buffer can either be a chunk of data
-// passed to Write(), or a single EOF (FIN) signal.
+// newSegment produces a segment of data which has not
+// been sent yet, subject to the remote and congestion
+// windows.
+func (s *simpleTcpSend) newSegment() *tcpSegment {
+	una := s.writeBuf.sequence
+	end := una + s.writeBuf.Remaining()
+	if !tcpSeqLess(s.sentSeq, end) {
+		return nil
+	}
+
+	pending := end - s.sentSeq
+	dataPending := pending
+	if s.writeBuf.sendEOF {
+		dataPending--
+	}
+
+	var usable uint32
+	if outstanding := s.sentSeq - una; s.window > outstanding {
+		usable = s.window - outstanding
+	}
+	rwndUsable := usable
+	if room := s.congestionRoom(); room < usable {
+		usable = room
+	}
+	size := uint32(s.maxSegmentSize)
+	if dataPending < size {
+		size = dataPending
+	}
+	if usable < size {
+		size = usable
+	}
+
+	if dataPending > 0 {
+		if size == 0 && s.probe {
+			// Probe the closed window with a single byte.
+			size = 1
+		} else if size == 0 || (size < uint32(s.maxSegmentSize) && size < dataPending &&
+			size < s.maxWindow/2 && len(s.inFlight) > 0) {
+			// Avoid silly window syndrome by waiting for the
+			// window to open further.
+			if rwndUsable == 0 && len(s.inFlight) == 0 && !s.timer.Running() {
+				// Persist timer to prevent deadlock.
+				s.timer.Start()
+			}
+			return nil
+		} else if size < uint32(s.maxSegmentSize) && len(s.inFlight) > 0 && !s.noDelay &&
+			!(s.hasUrgent && tcpSeqLess(s.sentSeq, s.urgentEnd)) {
+			// Nagle's algorithm: coalesce small segments
+			// until the outstanding data is acknowledged.
+			return nil
+		}
+	}
+	s.probe = false
+
+	segEnd := s.sentSeq + size
+	if size == dataPending {
+		// The FIN is not limited by the window.
+		segEnd = end
+	}
+	seg := s.writeBuf.Segment(s.sentSeq, segEnd)
+	s.inFlight = append(s.inFlight, &tcpSentSegment{
+		Start:  seg.Start,
+		End:    segEnd,
+		SentAt: s.clock.Now(),
+	})
+	s.sentSeq = segEnd
+	return seg
+}
+
+// congestionRoom gets the number of bytes which the
+// congestion window allows to be sent.
+func (s *simpleTcpSend) congestionRoom() uint32 {
+	cwnd := s.congestion.CongestionWindow()
+	if pipe := s.pipe(); pipe < cwnd {
+		return uint32(cwnd - pipe)
+	}
+	return 0
+}
+
+// pipe estimates the number of bytes in the network, as
+// described in RFC 6675.
+func (s *simpleTcpSend) pipe() int {
+	var res, sacked int
+	for _, seg := range s.inFlight {
+		if seg.Lost {
+			continue
+		}
+		start := int(seg.Start - s.writeBuf.sequence)
+		end := int(seg.End - s.writeBuf.sequence)
+		res += end - start
+		sacked += s.writeBuf.sacked.Count(start, end)
+	}
+
+	// Without SACK, duplicate acks are the only sign that
+	// data has left the network during fast recovery.
+	left := essentials.MaxInt(sacked, s.inflation)
+	return essentials.MaxInt(0, res-left)
+}
+
+// A tcpSentSegment records a range of sequence numbers
+// which has been sent but not acknowledged.
+type tcpSentSegment struct {
+	Start  uint32
+	End    uint32
+	SentAt time.Time
+
+	// Retransmitted is set if the segment has been sent
+	// more than once.
+	Retransmitted bool
+
+	// Lost is set if the segment should be retransmitted.
+	Lost bool
+}
+
+// A tcpWriteBuffer stores the outgoing data for a
+// simpleTcpSend until it is acknowledged.
+// The data may be followed by a single EOF (FIN) signal.
 type tcpWriteBuffer struct {
 	// The sequence number of the start of the buffer.
-	// If sendEOF is true, then instead of the buffer,
-	// this corresponds to the start of the EOF, or the
-	// end of the EOF if sentEOF is also true.
+	// If sentEOF is true, this is the end of the EOF.
 	sequence uint32
 
 	// If EOF is being sent, then sendEOF is true.
-	// At that point, buffer must be empty.
+	// At that point, no more data may be added.
 	sendEOF bool
 
 	// If EOF has been acknowledged, then sentEOF is true.
 	sentEOF bool
 
-	// The data to be sent.
+	// The data which has not been acknowledged, and the
+	// maximum amount of such data.
 	buffer []byte
+	size   int
+
+	// The scoreboard of selectively acknowledged ranges
+	// of buffer, which need not be retransmitted.
+	sacked tcpRangeSet
 }
 
-func newTCPWriteBuffer(seq uint32) *tcpWriteBuffer {
-	return &tcpWriteBuffer{sequence: seq}
+func newTCPWriteBuffer(seq uint32, size int) *tcpWriteBuffer {
+	return &tcpWriteBuffer{sequence: seq, size: size}
 }
 
-// SetData sets the outgoing data to send.
-func (t *tcpWriteBuffer) SetData(buffer []byte) {
-	if len(t.buffer) > 0 || t.sendEOF {
-		panic("already sending something")
+// Append copies as much data as fits into the buffer and
+// returns the number of bytes copied.
+func (t *tcpWriteBuffer) Append(data []byte) int {
+	if t.sendEOF {
+		panic("already sent EOF")
 	}
-	t.buffer = buffer
+	n := essentials.MinInt(len(data), t.size-len(t.buffer))
+	if n <= 0 {
+		return 0
+	}
+	// Segments may still refer to the buffered data, so
+	// it must never be overwritten in place.
+	t.buffer = append(t.buffer, data[:n]...)
+	return n
 }
 
-// SetEOF sets the outgoing data to an EOF.
+// SetEOF adds an EOF after the buffered data.
 func (t *tcpWriteBuffer) SetEOF() {
-	if len(t.buffer) > 0 {
-		panic("already sending something")
-	}
 	t.sendEOF = true
 }
 
@@ -239,104 +728,131 @@ func (t *tcpWriteBuffer) Handle(ack uint32) {
 		t.sequence += t.Remaining()
 		t.sentEOF = t.sendEOF
 		t.buffer = nil
+		t.sacked = nil
 	} else {
 		t.sequence += uint32(offset)
 		t.buffer = t.buffer[offset:]
+		t.sacked.Shift(int(offset))
 	}
 }
 
-// Segment creates the next tcpSegment.
-// The segment will not be larger than maxSize bytes.
-//
-// This should only be called if t.Remaining() > 0.
-func (t *tcpWriteBuffer) Segment(maxSize uint16) *tcpSegment {
-	if t.Remaining() == 0 {
-		panic("no data to write")
+// HandleSACK updates the scoreboard based on selective
+// acknowledgements.
+// Blocks which do not lie within the buffer are ignored.
+func (t *tcpWriteBuffer) HandleSACK(blocks []TCPSACKBlock) {
+	for _, block := range blocks {
+		start := block.Start - t.sequence
+		end := block.End - t.sequence
+		if start < end && end <= uint32(len(t.buffer)) {
+			t.sacked.Add(int(start), int(end))
+		}
 	}
+}
 
-	if t.sendEOF {
-		return &tcpSegment{
-			Start: t.sequence,
-			Fin:   true,
+// Segment creates a segment for the sequence numbers in
+// [start, end), skipping selectively acknowledged data
+// at the start of the range and stopping at the next
+// selectively acknowledged range.
+//
+// It returns nil if nothing in the range needs to be
+// sent.
+func (t *tcpWriteBuffer) Segment(start, end uint32) *tcpSegment {
+	s, e := int(start-t.sequence), int(end-t.sequence)
+	fin := t.sendEOF && !t.sentEOF && e > len(t.buffer)
+	if e > len(t.buffer) {
+		e = len(t.buffer)
+	}
+	if r, ok := t.sacked.Find(s); ok {
+		s = r.End
+	}
+	for _, r := range t.sacked {
+		if r.Start > s && r.Start < e {
+			e = r.Start
+			fin = false
+			break
 		}
 	}
-
-	buffer := t.buffer
-	if len(buffer) > int(maxSize) {
-		buffer = buffer[:maxSize]
+	if s >= e && !fin {
+		return nil
 	}
 	return &tcpSegment{
-		Start: t.sequence,
-		Data:  buffer,
+		Start: t.sequence + uint32(s),
+		Data:  t.buffer[s:e],
+		Fin:   fin,
 	}
 }
 
+// HighestSACK gets the sequence number after the highest
+// selectively acknowledged data.
+// The second return value is false if no data has been
+// selectively acknowledged.
+func (t *tcpWriteBuffer) HighestSACK() (uint32, bool) {
+	if len(t.sacked) == 0 {
+		return 0, false
+	}
+	return t.sequence + uint32(t.sacked[len(t.sacked)-1].End), true
+}
+
 // Remaining gets the number of sequence increments that
 // still must take place to finish the buffer.
 func (t *tcpWriteBuffer) Remaining() uint32 {
 	if t.sendEOF && !t.sentEOF {
-		return 1
+		return uint32(len(t.buffer)) + 1
 	}
 	return uint32(len(t.buffer))
 }
 
-// A tcpSendTimer manages retransmission and persist
-// timers for a simpleTcpSend.
+// A tcpSendTimer is a restartable retransmission and
+// persist timer for a simpleTcpSend.
+//
+// The timer shares its owner's lock. All methods must be
+// called with the lock held, and the callback is called
+// with the lock held.
 type tcpSendTimer struct {
-	lock  sync.Mutex
-	next  chan *tcpSegment
-	timer *time.Timer
+	lock     sync.Locker
+	clock    Clock
+	rto      *tcpRTOEstimator
+	callback func()
+	timer    Timer
 }
 
-func newTcpSendTimer() *tcpSendTimer {
+func newTcpSendTimer(lock sync.Locker, clock Clock, rto *tcpRTOEstimator,
+	callback func()) *tcpSendTimer {
 	return &tcpSendTimer{
-		next: make(chan *tcpSegment, 1),
+		lock:     lock,
+		clock:    clock,
+		rto:      rto,
+		callback: callback,
 	}
 }
 
-// Chan gets the channel of outgoing segments.
-func (t *tcpSendTimer) Chan() <-chan *tcpSegment {
-	return t.next
-}
-
-// Cancel stops any retry or persist timers.
-func (t *tcpSendTimer) Cancel() {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	if t.timer != nil {
-		t.timer.Stop()
+// Start starts the timer with the current retransmission
+// timeout, replacing any running timer.
+func (t *tcpSendTimer) Start() {
+	t.Stop()
+	var timer Timer
+	timer = t.clock.AfterFunc(t.rto.RTO(), func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if t.timer != timer {
+			// The timer was stopped after it fired.
+			return
+		}
 		t.timer = nil
-	}
-}
-
-// Schedule schedules a segment to be transmitted after a
-// reasonable time interval.
-//
-// This should be used for persist timers.
-func (t *tcpSendTimer) Schedule(seg *tcpSegment) {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	t.schedule(seg)
+		t.callback()
+	})
+	t.timer = timer
 }
 
-func (t *tcpSendTimer) schedule(seg *tcpSegment) {
+// Stop stops the timer if it is running.
+func (t *tcpSendTimer) Stop() {
 	if t.timer != nil {
 		t.timer.Stop()
+		t.timer = nil
 	}
-	t.timer = time.AfterFunc(time.Second, func() {
-		t.Send(seg)
-	})
 }
 
-// Send sends a segment to the next channel, and schedules
-// the segment to be resent if no Cancel() is called in a
-// reasonable time interval.
-func (t *tcpSendTimer) Send(seg *tcpSegment) {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	select {
-	case t.next <- seg:
-	default:
-	}
-	t.schedule(seg)
+// Running checks if the timer is running.
+func (t *tcpSendTimer) Running() bool {
+	return t.timer != nil
 }
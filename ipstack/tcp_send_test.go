@@ -3,28 +3,34 @@ package ipstack
 import (
 	"bytes"
 	"errors"
+	"io"
 	"testing"
+	"time"
 )
 
 func TestTCPSendNormal(t *testing.T) {
-	sender := newSimpleTcpSend(1337, 1000, 512)
+	sender := newSimpleTcpSend(1337, 1000, 512, newTCPConfig(nil))
 	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		n, err := sender.Write([]byte("hello, world!"))
 		if n != 13 || err != nil {
-			t.Fatal("unexpected result:", n, err)
+			t.Error("unexpected result:", n, err)
+			return
 		}
-		err = sender.Close()
-		if err != nil {
-			t.Fatal("close error:", err)
+		if err := sender.CloseWrite(); err != nil {
+			t.Error("close error:", err)
+			return
+		}
+		if err := sender.Wait(); err != nil {
+			t.Error("wait error:", err)
 		}
-		close(done)
 	}()
 	seg1 := <-sender.Next()
 	if seg1.Start != 1337 || !bytes.Equal(seg1.Data, []byte("hello, world!")) || seg1.Fin {
 		t.Fatal("unexpected segment")
 	}
-	sender.Handle(seg1.Start+uint32(len(seg1.Data)), 1000)
+	sender.Handle(seg1.Start+uint32(len(seg1.Data)), 1000, nil, false)
 	seg2 := <-sender.Next()
 	if seg2.Start != 1337+13 || len(seg2.Data) != 0 || !seg2.Fin {
 		t.Fatal("unexpected segment")
@@ -32,7 +38,7 @@ func TestTCPSendNormal(t *testing.T) {
 	if sender.Done() {
 		t.Fatal("done before final ack")
 	}
-	sender.Handle(1337+14, 1000)
+	sender.Handle(1337+14, 1000, nil, false)
 	if !sender.Done() {
 		t.Fatal("not done after final ack")
 	}
@@ -40,15 +46,369 @@ func TestTCPSendNormal(t *testing.T) {
 }
 
 func TestTCPSendFail(t *testing.T) {
-	sender := newSimpleTcpSend(1337, 1000, 512)
+	// The write cannot finish until data is acknowledged.
+	sender := newSimpleTcpSend(1337, 1000, 512, newTCPConfig(&TCPConfig{SendBuffer: 5}))
 	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		_, err := sender.Write([]byte("hello, world!"))
 		if err == nil || err.Error() != "error!" {
-			t.Fatal("unexpected error")
+			t.Error("unexpected error")
 		}
-		close(done)
 	}()
 	sender.Fail(errors.New("error!"))
 	<-done
 }
+
+func TestTCPSendCloseBlockedWrite(t *testing.T) {
+	sender := newSimpleTcpSend(1337, 1000, 512, newTCPConfig(&TCPConfig{SendBuffer: 5}))
+	res := make(chan error, 1)
+	go func() {
+		n, err := sender.Write([]byte("hello, world!"))
+		if n != 5 {
+			t.Error("unexpected count:", n)
+		}
+		res <- err
+	}()
+
+	// Once the first segment is out, the write is waiting
+	// for buffer space.
+	if seg := <-sender.Next(); string(seg.Data) != "hello" {
+		t.Fatal("unexpected segment")
+	}
+	if err := sender.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-res:
+		if err != io.ErrClosedPipe {
+			t.Fatal("expected closed pipe but got", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("write did not return")
+	}
+	sender.Handle(1337+5, 1000, nil, false)
+	if seg := <-sender.Next(); seg.Start != 1337+5 || !seg.Fin {
+		t.Fatal("unexpected segment")
+	}
+}
+
+func TestTCPSendBuffered(t *testing.T) {
+	sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(&TCPConfig{SendBuffer: 30}))
+	data := []byte("0123456789abcdefghijABCDE")
+	if n, err := sender.Write(data); n != len(data) || err != nil {
+		t.Fatal("unexpected result:", n, err)
+	}
+	copy(data, "XXXXXXXXXXXXXXXXXXXXXXXXX")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if n, err := sender.Write([]byte("FGHIJKLMNO")); n != 10 || err != nil {
+			t.Error("unexpected result:", n, err)
+		}
+	}()
+
+	var received []byte
+	for len(received) < 35 {
+		seg := <-sender.Next()
+		received = append(received, seg.Data...)
+		select {
+		case <-done:
+			if len(received) < 10 {
+				t.Fatal("write finished before buffer space was freed")
+			}
+		default:
+		}
+		sender.Handle(seg.End(), 1000, nil, false)
+	}
+	if string(received) != "0123456789abcdefghijABCDEFGHIJKLMNO" {
+		t.Fatal("unexpected data:", string(received))
+	}
+	<-done
+}
+
+func TestTCPSendWindow(t *testing.T) {
+	sender := newSimpleTcpSend(1337, 1000, 100, newTCPConfig(nil))
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go sender.Write(data)
+
+	expectSegments := func(start uint32, count int) {
+		for i := 0; i < count; i++ {
+			seg := <-sender.Next()
+			expected := data[start-1337 : start-1337+100]
+			if seg.Start != start || !bytes.Equal(seg.Data, expected) {
+				t.Fatal("unexpected segment", i, seg.Start, len(seg.Data))
+			}
+			start += 100
+		}
+		select {
+		case seg := <-sender.Next():
+			t.Fatal("unexpected segment beyond window:", seg.Start)
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	expectSegments(1337, 10)
+	if sender.Seq() != 1337+1000 {
+		t.Fatal("unexpected sequence number")
+	}
+
+	// A partial ack opens the window by 250 bytes.
+	sender.Handle(1337+250, 1000, nil, false)
+	expectSegments(1337+1000, 2)
+
+	// The window grows and the congestion window is
+	// still in slow start.
+	sender.Handle(1337+450, 1200, nil, false)
+	expectSegments(1337+1200, 4)
+}
+
+func TestTCPSendNagle(t *testing.T) {
+	for _, noDelay := range []bool{false, true} {
+		sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(nil))
+		sender.SetNoDelay(noDelay)
+		go sender.Write([]byte("0123456789abcdefghijABCDE"))
+		for i := 0; i < 2; i++ {
+			if seg := <-sender.Next(); len(seg.Data) != 10 {
+				t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+			}
+		}
+		if !noDelay {
+			select {
+			case seg := <-sender.Next():
+				t.Fatal("unexpected small segment", seg.Start, string(seg.Data))
+			case <-time.After(time.Millisecond * 10):
+			}
+			sender.Handle(1020, 1000, nil, false)
+		}
+		if seg := <-sender.Next(); seg.Start != 1020 || string(seg.Data) != "ABCDE" {
+			t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+		}
+	}
+}
+
+func TestTCPSendRetransmit(t *testing.T) {
+	sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(nil))
+	sender.rto.AddSample(time.Millisecond)
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	go sender.Write(data)
+	for i := 0; i < 4; i++ {
+		<-sender.Next()
+	}
+
+	// The second and fourth segments arrived.
+	sender.Handle(1010, 1000, []TCPSACKBlock{{1030, 1040}, {1020, 1030}}, false)
+
+	seg := <-sender.Next()
+	if seg.Start != 1010 || string(seg.Data) != "abcdefghij" {
+		t.Fatal("unexpected retransmission", seg.Start, string(seg.Data))
+	}
+	select {
+	case seg := <-sender.Next():
+		t.Fatal("unexpected retransmission", seg.Start, string(seg.Data))
+	case <-time.After(DefaultTCPMinRTO):
+	}
+
+	sender.Handle(1040, 1000, nil, false)
+	if sender.writeBuf.Remaining() != 0 || len(sender.inFlight) != 0 {
+		t.Fatal("data not acknowledged")
+	}
+}
+
+func TestTCPSendTimeout(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(&TCPConfig{Clock: clock}))
+	go sender.Write([]byte("0123456789"))
+	if seg := <-sender.Next(); seg.Retransmit {
+		t.Fatal("unexpected retransmission")
+	}
+	clock.WaitTimers(1)
+
+	// The timeout doubles after each retransmission.
+	for _, rto := range []time.Duration{DefaultTCPInitialRTO, DefaultTCPInitialRTO * 2} {
+		clock.Advance(rto - time.Millisecond)
+		select {
+		case seg := <-sender.Next():
+			t.Fatal("early retransmission", seg.Start)
+		default:
+		}
+		clock.Advance(time.Millisecond)
+		select {
+		case seg := <-sender.Next():
+			if seg.Start != 1000 || !seg.Retransmit {
+				t.Fatal("unexpected segment", seg.Start, seg.Retransmit)
+			}
+		default:
+			t.Fatal("no retransmission")
+		}
+	}
+	if stats := sender.RecoveryStats(); stats.Timeouts != 2 || stats.Retransmits != 2 {
+		t.Fatal("unexpected stats", stats)
+	}
+}
+
+func TestTCPSendGiveUp(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender := newSimpleTcpSend(1000, 1000, 10,
+		newTCPConfig(&TCPConfig{Clock: clock, Retransmits: 2}))
+	go sender.Write([]byte("0123456789"))
+	<-sender.Next()
+	clock.WaitTimers(1)
+
+	rto := DefaultTCPInitialRTO
+	for i := 0; i < 2; i++ {
+		clock.Advance(rto)
+		rto *= 2
+		select {
+		case seg := <-sender.Next():
+			if !seg.Retransmit {
+				t.Fatal("expected retransmission")
+			}
+		case <-sender.TimedOut():
+			t.Fatal("gave up too early")
+		}
+	}
+	clock.Advance(rto)
+	select {
+	case <-sender.TimedOut():
+	default:
+		t.Fatal("did not give up")
+	}
+	if _, err := sender.Write([]byte("x")); err != retransmitTimeoutErr {
+		t.Fatal("expected timeout but got", err)
+	}
+}
+
+func TestTCPSendRTT(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(&TCPConfig{Clock: clock}))
+	go sender.Write([]byte("0123456789"))
+	<-sender.Next()
+	clock.Advance(time.Millisecond * 50)
+	sender.Handle(1010, 1000, nil, false)
+	if rtt := sender.RTT(); rtt != time.Millisecond*50 {
+		t.Fatal("unexpected RTT", rtt)
+	}
+}
+
+func TestTCPSendFastRetransmit(t *testing.T) {
+	sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(nil))
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMN")
+	go sender.Write(data)
+	for i := 0; i < 5; i++ {
+		<-sender.Next()
+	}
+
+	expectRetransmit := func(start uint32) {
+		select {
+		case seg := <-sender.Next():
+			if seg.Start != start || !bytes.Equal(seg.Data, data[start-1000:start-990]) {
+				t.Fatal("unexpected retransmission", seg.Start, string(seg.Data))
+			}
+		case <-time.After(DefaultTCPMinRTO / 2):
+			t.Fatal("no retransmission of", start)
+		}
+	}
+
+	// Segments carrying data are not duplicate acks.
+	sender.Handle(1010, 1000, nil, false)
+	for i := 0; i < 3; i++ {
+		sender.Handle(1010, 1000, nil, true)
+	}
+	if stats := sender.RecoveryStats(); stats.FastRetransmits != 0 {
+		t.Fatal("unexpected stats", stats)
+	}
+
+	// The second and fourth segments were lost.
+	for i := 0; i < 3; i++ {
+		sender.Handle(1010, 1000, nil, false)
+	}
+	expectRetransmit(1010)
+	sender.Handle(1030, 1000, nil, false)
+	expectRetransmit(1030)
+	sender.Handle(1050, 1000, nil, false)
+
+	stats := sender.RecoveryStats()
+	if stats.FastRetransmits != 1 || stats.Retransmits != 2 || stats.Timeouts != 0 {
+		t.Fatal("unexpected stats", stats)
+	}
+	if sender.recovering || sender.writeBuf.Remaining() != 0 {
+		t.Fatal("unexpected final state")
+	}
+}
+
+func TestTCPSendSACKRecovery(t *testing.T) {
+	// The clock never moves, so nothing times out.
+	clock := NewManualClock(time.Unix(0, 0))
+	sender := newSimpleTcpSend(1000, 1000, 10, newTCPConfig(&TCPConfig{Clock: clock}))
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	go sender.Write(data)
+	for i := 0; i < 6; i++ {
+		<-sender.Next()
+	}
+
+	// The second and fourth segments were lost, and both
+	// holes are repaired without waiting for a partial ack.
+	sender.Handle(1010, 1000, nil, false)
+	sender.Handle(1010, 1000, []TCPSACKBlock{{1020, 1030}}, false)
+	sender.Handle(1010, 1000, []TCPSACKBlock{{1040, 1050}, {1020, 1030}}, false)
+	sender.Handle(1010, 1000, []TCPSACKBlock{{1040, 1060}, {1020, 1030}}, false)
+	for _, start := range []uint32{1010, 1030} {
+		select {
+		case seg := <-sender.Next():
+			if seg.Start != start || !bytes.Equal(seg.Data, data[start-1000:start-990]) {
+				t.Fatal("unexpected retransmission", seg.Start, string(seg.Data))
+			}
+		case <-time.After(DefaultTCPMinRTO / 2):
+			t.Fatal("no retransmission of", start)
+		}
+	}
+
+	// The partial ack does not repeat the retransmission.
+	sender.Handle(1030, 1000, []TCPSACKBlock{{1040, 1060}}, false)
+	select {
+	case seg := <-sender.Next():
+		t.Fatal("unexpected retransmission", seg.Start, string(seg.Data))
+	case <-time.After(DefaultTCPMinRTO / 2):
+	}
+	sender.Handle(1060, 1000, nil, false)
+
+	stats := sender.RecoveryStats()
+	if stats.FastRetransmits != 1 || stats.Retransmits != 2 || stats.Timeouts != 0 {
+		t.Fatal("unexpected stats", stats)
+	}
+	if sender.recovering {
+		t.Fatal("still recovering")
+	}
+}
+
+func TestTCPWriteBufferSACK(t *testing.T) {
+	buf := newTCPWriteBuffer(1000, 100)
+	buf.Append([]byte("0123456789abcdefghij"))
+	buf.HandleSACK([]TCPSACKBlock{{1005, 1010}, {1015, 1018}, {990, 1002}, {1018, 1030}})
+	seg := buf.Segment(1000, 1020)
+	if seg.Start != 1000 || string(seg.Data) != "01234" {
+		t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+	}
+	buf.Handle(1005)
+	seg = buf.Segment(1005, 1013)
+	if seg.Start != 1010 || string(seg.Data) != "abc" {
+		t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+	}
+	seg = buf.Segment(1005, 1020)
+	if seg.Start != 1010 || string(seg.Data) != "abcde" {
+		t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+	}
+	if seg := buf.Segment(1005, 1010); seg != nil {
+		t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+	}
+	buf.Handle(1015)
+	seg = buf.Segment(1015, 1020)
+	if seg.Start != 1018 || string(seg.Data) != "ij" {
+		t.Fatal("unexpected segment", seg.Start, string(seg.Data))
+	}
+}
@@ -0,0 +1,64 @@
+package ipstack
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ConnectionRefusedErr = errors.New("connection refused")
+	ConnectionResetErr   = errors.New("connection reset by peer")
+)
+
+// tcpMSL is the maximum segment lifetime.
+// Connections which close actively wait in TIME_WAIT for
+// twice this long.
+const tcpMSL = 30 * time.Second
+
+// tcpFinWait2Timeout is how long a closed connection
+// waits in FIN-WAIT-2 for the remote end's FIN, like
+// tcp_fin_timeout in Linux.
+const tcpFinWait2Timeout = 60 * time.Second
+
+// A TCPState is a state in the TCP state machine, as
+// described in RFC 9293.
+//
+// Connections are only created once the handshake is
+// complete, so the LISTEN, SYN-SENT, and SYN-RECEIVED
+// states have no TCPState.
+type TCPState int
+
+const (
+	TCPClosed TCPState = iota
+	TCPEstablished
+	TCPFinWait1
+	TCPFinWait2
+	TCPCloseWait
+	TCPClosing
+	TCPLastAck
+	TCPTimeWait
+)
+
+// String returns the RFC name of the state.
+func (t TCPState) String() string {
+	switch t {
+	case TCPClosed:
+		return "CLOSED"
+	case TCPEstablished:
+		return "ESTABLISHED"
+	case TCPFinWait1:
+		return "FIN-WAIT-1"
+	case TCPFinWait2:
+		return "FIN-WAIT-2"
+	case TCPCloseWait:
+		return "CLOSE-WAIT"
+	case TCPClosing:
+		return "CLOSING"
+	case TCPLastAck:
+		return "LAST-ACK"
+	case TCPTimeWait:
+		return "TIME-WAIT"
+	default:
+		return "UNKNOWN"
+	}
+}
@@ -0,0 +1,51 @@
+package ipstack
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestTCPOptions(t *testing.T) {
+	source := &net.TCPAddr{IP: net.IP{10, 0, 0, 1}, Port: 1337}
+	dest := &net.TCPAddr{IP: net.IP{10, 0, 0, 2}, Port: 80}
+	options := []*TCPOption{
+		{Kind: TCPOptionNop},
+		NewTCPOptionMSS(1460),
+		{Kind: 0x99, Data: []byte{1, 2, 3}},
+		NewTCPOptionTimestamps(0xdeadbeef, 7),
+	}
+	packet := NewTCP4PacketOptions(DefaultTTL, source, dest, 1, 2, 1000, options,
+		[]byte("hello"), SYN)
+	if !packet.Valid() || packet.Checksum() != 0 {
+		t.Fatal("invalid packet")
+	}
+	if len(packet.Header()) != 40 {
+		t.Fatal("unexpected header size", len(packet.Header()))
+	}
+	if !bytes.Equal(packet.Payload(), []byte("hello")) {
+		t.Fatal("unexpected payload")
+	}
+	parsed, err := packet.Header().TCPOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(options) {
+		t.Fatal("unexpected number of options", len(parsed))
+	}
+	for i, expected := range options {
+		actual := parsed[i]
+		if actual.Kind != expected.Kind || !bytes.Equal(actual.Data, expected.Data) {
+			t.Errorf("option %d: expected %v but got %v", i, expected, actual)
+		}
+	}
+	if mss, ok := parsed[1].MSS(); !ok || mss != 1460 {
+		t.Error("unexpected MSS", mss, ok)
+	}
+	if _, ok := parsed[2].MSS(); ok {
+		t.Error("unexpected MSS option")
+	}
+	if val, ecr, ok := parsed[3].Timestamps(); !ok || val != 0xdeadbeef || ecr != 7 {
+		t.Error("unexpected timestamps", val, ecr, ok)
+	}
+}
@@ -0,0 +1,127 @@
+package ipstack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// tcpTimestampTick is the resolution of the clock used
+// for timestamp values.
+const tcpTimestampTick = time.Millisecond
+
+// tcpTimestampsSize is the number of bytes which the
+// timestamps option adds to a header, including padding.
+const tcpTimestampsSize = 12
+
+// tcpPAWSIdle is how long TS.Recent stays valid while no
+// segments update it, as described in RFC 7323.
+const tcpPAWSIdle = 24 * 24 * time.Hour
+
+// A tcpTimestamps tracks the timestamps option of a
+// connection, as described in RFC 7323.
+//
+// Echoed timestamps are used to measure round-trip
+// times, and to implement PAWS (Protection Against
+// Wrapped Sequences), which rejects old segments whose
+// sequence numbers have wrapped back into the window.
+//
+// A tcpTimestamps is not safe to use from multiple
+// Goroutines.
+type tcpTimestamps struct {
+	clock Clock
+
+	// offset is added to every timestamp value, so that
+	// the values do not reveal the clock.
+	offset uint32
+
+	// recent is TS.Recent, the timestamp value to echo,
+	// and recentTime is when it was last updated.
+	recent     uint32
+	recentTime time.Time
+
+	// lastAckSent is Last.ACK.sent, the ack number of the
+	// last outgoing segment.
+	lastAckSent uint32
+}
+
+func newTCPTimestamps(clock Clock) *tcpTimestamps {
+	var offset [4]byte
+	if _, err := rand.Read(offset[:]); err != nil {
+		panic(err)
+	}
+	return &tcpTimestamps{clock: clock, offset: binary.BigEndian.Uint32(offset[:])}
+}
+
+// Now gets the current timestamp value.
+func (t *tcpTimestamps) Now() uint32 {
+	return uint32(t.clock.Now().UnixNano()/int64(tcpTimestampTick)) + t.offset
+}
+
+// Option creates the timestamps option for an outgoing
+// segment which acknowledges ack.
+func (t *tcpTimestamps) Option(ack uint32) *TCPOption {
+	t.lastAckSent = ack
+	return NewTCPOptionTimestamps(t.Now(), t.recent)
+}
+
+// SetRecent sets the timestamp value to echo.
+func (t *tcpTimestamps) SetRecent(val uint32) {
+	t.recent = val
+	t.recentTime = t.clock.Now()
+}
+
+// Check performs the PAWS test on the timestamp value of
+// an incoming segment. It returns false if the segment
+// is an old duplicate.
+func (t *tcpTimestamps) Check(val uint32) bool {
+	if !tcpSeqLess(val, t.recent) {
+		return true
+	}
+	if t.clock.Now().Sub(t.recentTime) > tcpPAWSIdle {
+		// The connection has been idle for so long that
+		// TS.Recent may have wrapped.
+		t.SetRecent(val)
+		return true
+	}
+	return false
+}
+
+// Update updates TS.Recent after an acceptable segment.
+//
+// Only segments at or before the last ack sent are used,
+// so that a delayed ACK echoes the earliest segment it
+// acknowledges.
+func (t *tcpTimestamps) Update(seq, val uint32) {
+	if !tcpSeqLess(val, t.recent) && !tcpSeqLess(t.lastAckSent, seq) {
+		t.SetRecent(val)
+	}
+}
+
+// RTT computes the round-trip time from an echoed
+// timestamp value.
+//
+// The second return value is false if the echoed value
+// is in the future, so it cannot be a real echo.
+func (t *tcpTimestamps) RTT(ecr uint32) (time.Duration, bool) {
+	elapsed := int32(t.Now() - ecr)
+	if elapsed < 0 {
+		return 0, false
+	}
+	return time.Duration(elapsed) * tcpTimestampTick, true
+}
+
+// tcpTimestampsOption finds the timestamps option in a
+// header.
+func tcpTimestampsOption(header TCPHeader) (val, ecr uint32, ok bool) {
+	options, err := header.TCPOptions()
+	if err != nil {
+		return 0, 0, false
+	}
+	for _, option := range options {
+		if val, ecr, ok := option.Timestamps(); ok {
+			return val, ecr, true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,52 @@
+package ipstack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTCPTimestampsPAWS(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	ts := newTCPTimestamps(clock)
+	ts.SetRecent(1000)
+	ts.lastAckSent = 500
+
+	if !ts.Check(1000) || !ts.Check(1001) {
+		t.Error("rejected current timestamp")
+	}
+	if ts.Check(999) {
+		t.Error("accepted old timestamp")
+	}
+
+	// Only segments at or before the last ACK update
+	// TS.Recent.
+	ts.Update(501, 2000)
+	if ts.recent != 1000 {
+		t.Error("unexpected update", ts.recent)
+	}
+	ts.Update(500, 2000)
+	if ts.recent != 2000 {
+		t.Error("missing update", ts.recent)
+	}
+
+	clock.Advance(tcpPAWSIdle + time.Second)
+	if !ts.Check(5) {
+		t.Error("rejected timestamp after idle period")
+	}
+	if ts.recent != 5 {
+		t.Error("TS.Recent was not reset", ts.recent)
+	}
+}
+
+func TestTCPTimestampsRTT(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	ts := newTCPTimestamps(clock)
+	val := ts.Now()
+	clock.Advance(25 * time.Millisecond)
+	if rtt, ok := ts.RTT(val); !ok || rtt != 25*time.Millisecond {
+		t.Error("unexpected RTT", rtt, ok)
+	}
+	if _, ok := ts.RTT(val + 100); ok {
+		t.Error("accepted echo from the future")
+	}
+}